@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+//Scopes that can be granted to a token, a higher scope includes the lower ones
+type Scope int
+
+const (
+	None Scope = iota //No access
+	Read //Query endpoints like getdef and getact
+	Mutate //Endpoints that change the state, like set, load and stop
+)
+
+//Result of checking the token of a request
+const (
+	Allowed = iota //The token grants the required scope
+	Unauthorized //There is no token or it is not valid
+	Forbidden //The token is valid but does not grant the required scope
+)
+
+//Returns the name of the scope
+func (s Scope) String() string {
+	switch s {
+	case Read:
+		return "read"
+	case Mutate:
+		return "mutate"
+	}
+	return "none"
+}
+
+//Get the scope from its name
+func ParseScope(name string) (Scope, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "read":
+		return Read, nil
+	case "mutate":
+		return Mutate, nil
+	}
+	return None, fmt.Errorf("invalid scope: %s, valid scopes are: read, mutate", name)
+}
+
+//A token and the scope it grants
+type token struct {
+	value []byte
+	scope Scope
+}
+
+//Set of tokens accepted by the application.  An empty set disables authentication
+type TokenSet struct {
+	tokens []token
+}
+
+//Loads the tokens from a comma separated list and from a file with one token per line.
+//Every token has the form token:scope, if the scope is missing read is assumed.  In the file empty lines and lines starting with # are ignored
+func Load(list string, file string) (*TokenSet, error) {
+	ts := &TokenSet{}
+	for _, entry := range strings.Split(list, ",") {
+		if err := ts.add(entry); err != nil {
+			return nil, err
+		}
+	}
+	if file != "" {
+		fd, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		scanner := bufio.NewScanner(fd)
+		line := 0
+		for scanner.Scan() {
+			line++
+			entry := strings.TrimSpace(scanner.Text())
+			if strings.HasPrefix(entry, "#") {
+				continue
+			}
+			if err := ts.add(entry); err != nil {
+				return nil, fmt.Errorf("%s line %d: %s", file, line, err.Error())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+//Adds a token:scope entry to the set, empty entries are ignored
+func (ts *TokenSet) add(entry string) error {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return nil
+	}
+	value, scope := entry, Read
+	if sep := strings.LastIndex(entry, ":"); sep >= 0 {
+		var err error
+		value = entry[:sep]
+		scope, err = ParseScope(entry[sep+1:])
+		if err != nil {
+			return err
+		}
+	}
+	if value == "" {
+		return fmt.Errorf("empty token")
+	}
+	ts.tokens = append(ts.tokens, token{value: []byte(value), scope: scope})
+	return nil
+}
+
+//True if there is at least one token, so requests must be authenticated
+func (ts *TokenSet) Enabled() bool {
+	return ts != nil && len(ts.tokens) > 0
+}
+
+//Number of tokens granting each scope
+func (ts *TokenSet) Count(scope Scope) int {
+	count := 0
+	for _, t := range ts.tokens {
+		if t.scope == scope {
+			count++
+		}
+	}
+	return count
+}
+
+//Check if the bearer token of the request grants the required scope
+func (ts *TokenSet) Check(request *http.Request, required Scope) int {
+	if !ts.Enabled() || required == None { //Endpoints that require no scope are public
+		return Allowed
+	}
+	scope := ts.lookup(BearerToken(request))
+	if scope == None {
+		return Unauthorized
+	}
+	if scope < required {
+		return Forbidden
+	}
+	return Allowed
+}
+
+//Get the scope granted by the token.  All the tokens are compared in constant time so the response time does not leak information
+func (ts *TokenSet) lookup(value string) Scope {
+	scope := None
+	if value == "" {
+		return scope
+	}
+	for _, t := range ts.tokens {
+		if subtle.ConstantTimeCompare(t.value, []byte(value)) == 1 && t.scope > scope {
+			scope = t.scope
+		}
+	}
+	return scope
+}
+
+//Get the token from the Authorization header of the request, empty if there is none
+func BearerToken(request *http.Request) string {
+	header := request.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
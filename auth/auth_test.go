@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	content := "# Tokens of the monitoring\nmon-token\n\n  ops-token:mutate  \nurl:token:read\n"
+	if err = ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := Load("list-token:mutate, other-token ,", file)
+	if err != nil {
+		t.Fatalf("Load(): %v", err)
+	}
+	scopes := map[string]Scope{"list-token": Mutate, "other-token": Read, "mon-token": Read, "ops-token": Mutate, "url:token": Read,
+		"# Tokens of the monitoring": None, "unknown": None, "": None}
+	for value, scope := range scopes {
+		if got := ts.lookup(value); got != scope {
+			t.Errorf("scope of %q = %s, want %s", value, got, scope)
+		}
+	}
+	if ts.Count(Read) != 3 || ts.Count(Mutate) != 2 {
+		t.Errorf("Count() = %d read and %d mutate, want 3 and 2", ts.Count(Read), ts.Count(Mutate))
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "tokens")
+	if err = ioutil.WriteFile(file, []byte("good:read\nbad:admin\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		list, file string
+	}{
+		{"token:admin", ""},
+		{":read", ""},
+		{"", file},
+		{"", filepath.Join(dir, "missing")},
+	}
+	for _, tt := range tests {
+		if _, err := Load(tt.list, tt.file); err == nil {
+			t.Errorf("Load(%q, %q) did not fail", tt.list, tt.file)
+		}
+	}
+	ts, err := Load("", "")
+	if err != nil || ts.Enabled() {
+		t.Errorf("Load() without tokens = %v, enabled %t, want no error and disabled", err, ts.Enabled())
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ts, _ := Load("reader:read,writer:mutate", "")
+	tests := []struct {
+		header string
+		required Scope
+		result int
+	}{
+		{"", None, Allowed},
+		{"", Read, Unauthorized},
+		{"Bearer wrong", Read, Unauthorized},
+		{"Bearer reader", Read, Allowed},
+		{"Bearer reader", Mutate, Forbidden},
+		{"Bearer writer", Mutate, Allowed},
+		{"Bearer writer", Read, Allowed},
+	}
+	for _, tt := range tests {
+		request, _ := http.NewRequest("GET", "/api/mem/set", nil)
+		if tt.header != "" {
+			request.Header.Set("Authorization", tt.header)
+		}
+		if result := ts.Check(request, tt.required); result != tt.result {
+			t.Errorf("Check(%q, %s) = %d, want %d", tt.header, tt.required, result, tt.result)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package cgroup
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//Mount point of the cgroup file system inside the container, can be changed to read another tree like in tests
+var Root = "/sys/fs/cgroup"
+
+//Values over this one in cgroup v1 limits mean there is no limit, the kernel uses the maximum page aligned int64
+const unlimitedV1 = 1 << 62
+
+//Get the version of cgroups in use: "v2", "v1" or "" if none is found
+func Version() string {
+	if _, err := os.Stat(Root + "/cgroup.controllers"); err == nil {
+		return "v2"
+	}
+	if _, err := os.Stat(Root + "/memory"); err == nil {
+		return "v1"
+	}
+	if _, err := os.Stat(Root + "/cpu"); err == nil {
+		return "v1"
+	}
+	return ""
+}
+
+//Get the memory limit of the cgroup in bytes, and the file it was read from.  Returns 0 if there is no limit
+func MemoryLimit() (uint64, string) {
+	var filename string
+	switch Version() {
+	case "v2":
+		filename = Root + "/memory.max" //Contains "max" when there is no limit
+	case "v1":
+		filename = Root + "/memory/memory.limit_in_bytes"
+	default:
+		return 0, ""
+	}
+	limit := readUint(filename)
+	if limit >= unlimitedV1 {
+		return 0, filename
+	}
+	return limit, filename
+}
+
+//Get the memory used by the cgroup in bytes, not counting the inactive page cache that can be reclaimed.
+//This is the working set that counts towards the limit, as computed by the kubelet
+func MemoryUsage() uint64 {
+	var usage, inactive uint64
+	switch Version() {
+	case "v2":
+		usage = readUint(Root + "/memory.current")
+		inactive = readStat(Root+"/memory.stat", "inactive_file")
+	case "v1":
+		usage = readUint(Root + "/memory/memory.usage_in_bytes")
+		inactive = readStat(Root+"/memory/memory.stat", "total_inactive_file")
+	}
+	if inactive > usage {
+		return 0
+	}
+	return usage - inactive
+}
+
+//Get the memory available in the cgroup, the limit minus the working set, and the file the limit was read from.
+//Returns 0 if there is no limit
+func MemoryAvailable() (uint64, string) {
+	limit, filename := MemoryLimit()
+	if limit == 0 {
+		return 0, filename
+	}
+	usage := MemoryUsage()
+	if usage >= limit {
+		return 0, filename
+	}
+	return limit - usage, filename
+}
+
+//Get the number of CPUs allowed by the cgroup quota, rounded up, and the file it was read from.  Returns 0 if there is no quota
+func CpuQuota() (int, string) {
+	var quota, period uint64
+	var filename string
+	switch Version() {
+	case "v2": //Contains "<quota> <period>" or "max <period>"
+		filename = Root + "/cpu.max"
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return 0, ""
+		}
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, filename
+		}
+		quota, _ = strconv.ParseUint(fields[0], 10, 64)
+		period, _ = strconv.ParseUint(fields[1], 10, 64)
+	case "v1": //Quota is -1 when there is no limit, so it is read as 0
+		filename = Root + "/cpu/cpu.cfs_quota_us"
+		quota = readUint(filename)
+		period = readUint(Root + "/cpu/cpu.cfs_period_us")
+	default:
+		return 0, ""
+	}
+	if quota == 0 || period == 0 {
+		return 0, filename
+	}
+	return int((quota + period - 1) / period), filename
+}
+
+//Read a file containing a single unsigned integer, returns 0 if it can't be read
+func readUint(filename string) uint64 {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return 0
+	}
+	value, err := strconv.ParseUint(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return value
+}
+
+//Read the value of a key from a stat file with "<key> <value>" lines, returns 0 if it can't be read
+func readStat(filename string, key string) uint64 {
+	fd, err := os.Open(filename)
+	if err != nil {
+		return 0
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == key {
+			value, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return value
+		}
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package cgroup
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+//Creates a cgroup file system with the files specified and uses it as root until the returned function is called
+func fakeRoot(t *testing.T, files map[string]string) func() {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previous := Root
+	Root = dir
+	return func() {
+		Root = previous
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMemory(t *testing.T) {
+	tests := []struct {
+		name string
+		files map[string]string
+		version string
+		limit, usage, available uint64
+	}{
+		{"v2 with limit", map[string]string{"cgroup.controllers": "", "memory.max": "1000\n", "memory.current": "600\n",
+			"memory.stat": "anon 400\ninactive_file 100\n"}, "v2", 1000, 500, 500},
+		{"v2 without limit", map[string]string{"cgroup.controllers": "", "memory.max": "max\n", "memory.current": "600\n"}, "v2", 0, 600, 0},
+		{"v2 usage at the limit", map[string]string{"cgroup.controllers": "", "memory.max": "1000\n", "memory.current": "1200\n",
+			"memory.stat": "inactive_file 100\n"}, "v2", 1000, 1100, 0},
+		{"v1 with limit", map[string]string{"memory/memory.limit_in_bytes": "2000\n", "memory/memory.usage_in_bytes": "900\n",
+			"memory/memory.stat": "total_inactive_file 200\n"}, "v1", 2000, 700, 1300},
+		{"v1 without limit", map[string]string{"memory/memory.limit_in_bytes": "9223372036854771712\n", "memory/memory.usage_in_bytes": "900\n"}, "v1", 0, 900, 0},
+		{"no cgroup", map[string]string{}, "", 0, 0, 0},
+	}
+	for _, tt := range tests {
+		cleanup := fakeRoot(t, tt.files)
+		limit, _ := MemoryLimit()
+		available, _ := MemoryAvailable()
+		if Version() != tt.version || limit != tt.limit || MemoryUsage() != tt.usage || available != tt.available {
+			t.Errorf("%s: version %q, limit %d, usage %d, available %d, want %q, %d, %d, %d", tt.name, Version(), limit, MemoryUsage(), available, tt.version, tt.limit, tt.usage, tt.available)
+		}
+		cleanup()
+	}
+}
+
+func TestCpuQuota(t *testing.T) {
+	tests := []struct {
+		name string
+		files map[string]string
+		cpus int
+	}{
+		{"v2 quota", map[string]string{"cgroup.controllers": "", "cpu.max": "150000 100000\n"}, 2},
+		{"v2 whole cpus", map[string]string{"cgroup.controllers": "", "cpu.max": "200000 100000\n"}, 2},
+		{"v2 no quota", map[string]string{"cgroup.controllers": "", "cpu.max": "max 100000\n"}, 0},
+		{"v1 quota", map[string]string{"cpu/cpu.cfs_quota_us": "50000\n", "cpu/cpu.cfs_period_us": "100000\n"}, 1},
+		{"v1 no quota", map[string]string{"cpu/cpu.cfs_quota_us": "-1\n", "cpu/cpu.cfs_period_us": "100000\n"}, 0},
+	}
+	for _, tt := range tests {
+		cleanup := fakeRoot(t, tt.files)
+		if cpus, _ := CpuQuota(); cpus != tt.cpus {
+			t.Errorf("%s: CpuQuota() = %d, want %d", tt.name, cpus, tt.cpus)
+		}
+		cleanup()
+	}
+}
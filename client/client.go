@@ -0,0 +1,486 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/tale-toul/testero/limits"
+	"github.com/tale-toul/testero/partdisk"
+	"github.com/tale-toul/testero/partmem"
+	"github.com/tale-toul/testero/requests"
+	"github.com/tale-toul/testero/scenario"
+	"github.com/tale-toul/testero/ttl"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Error codes returned by the API in JSON responses
+const (
+	CodeBusy = "server_busy"
+	CodePending = "pending_request"
+	CodeOverLimit = "over_limit"
+	CodeInvalid = "invalid_parameter"
+	CodeNoRequest = "no_request"
+	CodeMismatch = "id_mismatch"
+	CodeInternal = "internal_error"
+	CodeUnauthorized = "unauthorized"
+	CodeForbidden = "forbidden"
+)
+
+//Error returned by the API
+type Error struct {
+	Status int //HTTP status
+	Code string //One of the Code constants
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%s)", e.Message, e.Code)
+}
+
+//Check if err is an API error with the code
+func IsCode(err error, code string) bool {
+	apierr, ok := err.(*Error)
+	return ok && apierr.Code == code
+}
+
+//Client of the testero API
+type Client struct {
+	BaseURL string //Like http://testero:8080
+	Token string //Bearer token, empty to send none
+	HTTPClient *http.Client
+	Retries int //Number of times a request is tried again when the server is busy or has a pending request
+	RetryDelay time.Duration //Time between retries
+}
+
+//Creates a client for the testero instance at baseURL, that retries busy requests 5 times
+func New(baseURL string, token string) *Client {
+	return &Client{
+		BaseURL: strings.TrimRight(baseURL, "/"),
+		Token: token,
+		HTTPClient: http.DefaultClient,
+		Retries: 5,
+		RetryDelay: 2 * time.Second,
+	}
+}
+
+//Sends a request to the endpoint at path and decodes the JSON response into out, if not nil.
+//The request is tried again if the server is busy or has a pending request
+func (c *Client) call(method string, path string, params url.Values, body []byte, out interface{}) error {
+	if params == nil {
+		params = url.Values{}
+	}
+	params.Set("format", "json")
+	target := c.BaseURL + path + "?" + params.Encode()
+	for attempt := 0; ; attempt++ {
+		err := c.do(method, target, body, out)
+		if (IsCode(err, CodeBusy) || IsCode(err, CodePending)) && attempt < c.Retries {
+			time.Sleep(c.RetryDelay)
+			continue
+		}
+		return err
+	}
+}
+
+//Sends a single request and decodes the response
+func (c *Client) do(method string, target string, body []byte, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequest(method, target, reader)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if c.Token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	response, err := c.HTTPClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		var apierr struct {
+			Error Error `json:"error"`
+		}
+		if json.Unmarshal(data, &apierr) != nil || apierr.Error.Code == "" {
+			return &Error{Status: response.StatusCode, Code: CodeInternal, Message: fmt.Sprintf("unexpected response: %s", response.Status)}
+		}
+		apierr.Error.Status = response.StatusCode
+		return &apierr.Error
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+//Response to a memory or disk request that was queued
+type Submitted struct {
+	RequestID int64 `json:"request_id"`
+	Size uint64 `json:"size"` //Bytes to set, add or remove depending on the operation
+	SizeHuman string `json:"size_human"`
+	Operation string `json:"operation"` //set, grow or shrink
+	TTL float64 `json:"ttl_seconds"`
+	State string `json:"state"`
+	Position int `json:"position"`
+}
+
+//Response to a cancel request
+type Cancellation struct {
+	RequestID int64 `json:"request_id"`
+	State string `json:"state"` //cancelled if it was queued, running while a running request stops
+}
+
+//Optional parameters of a memory request, the zero value uses the defaults of the server
+type MemoryOptions struct {
+	Fill string //zero, touch, random or ascii
+	Policy string //queue, replace or reject
+	TTL time.Duration //Negative to send ttl=0, so the allocation does not expire even if the server has a DEFAULT_TTL
+}
+
+//Optional parameters of a disk request, the zero value uses the defaults of the server
+type DiskOptions struct {
+	Content string //random, zero or ascii
+	Ratio uint64 //Compression ratio for random content
+	Mode string //write, fallocate or sparse
+	Policy string //queue, replace or reject
+	TTL time.Duration //Negative to send ttl=0
+}
+
+//Memory parts created or defined, with the limit and the time to live
+type MemoryReport struct {
+	Report partmem.PartsReport `json:"report"`
+	Limit uint64 `json:"limit"`
+	LimitSource string `json:"limit_source"`
+	TTL ttl.Status `json:"ttl"` //Only set for the actual parts
+}
+
+//Files created or defined, with the limit and the time to live
+type DiskReport struct {
+	Report partdisk.FilesReport `json:"report"`
+	Limit uint64 `json:"limit"`
+	LimitSource string `json:"limit_source"`
+	TTL ttl.Status `json:"ttl"` //Only set for the actual files
+}
+
+//Adds the ttl parameter if set
+func setTTL(params url.Values, lifetime time.Duration) {
+	if lifetime < 0 {
+		params.Set("ttl", "0")
+	} else if lifetime > 0 {
+		params.Set("ttl", lifetime.String())
+	}
+}
+
+//Sets the memory held to size, like 2Gi, or changes it with a relative size like +256Mi or -1Gi
+func (c *Client) SetMemory(size string, opts MemoryOptions) (*Submitted, error) {
+	params := url.Values{"size": {size}}
+	if opts.Fill != "" {
+		params.Set("fill", opts.Fill)
+	}
+	if opts.Policy != "" {
+		params.Set("policy", opts.Policy)
+	}
+	setTTL(params, opts.TTL)
+	sub := &Submitted{}
+	return sub, c.call("GET", "/api/mem/set", params, nil, sub)
+}
+
+//Releases all the memory
+func (c *Client) ReleaseMemory(policy string) (*Submitted, error) {
+	params := url.Values{}
+	if policy != "" {
+		params.Set("policy", policy)
+	}
+	sub := &Submitted{}
+	return sub, c.call("GET", "/api/mem/release", params, nil, sub)
+}
+
+//Changes the time to live of the memory held, counting from now.  0 removes the expiration
+func (c *Client) SetMemoryTTL(lifetime time.Duration) (*ttl.Status, error) {
+	status := &ttl.Status{}
+	return status, c.call("GET", "/api/mem/ttl", url.Values{"ttl": {lifetime.String()}}, nil, status)
+}
+
+//Cancels a memory request.  A running request keeps the parts created so far
+func (c *Client) CancelMemory(id int64) (*Cancellation, error) {
+	cancellation := &Cancellation{}
+	return cancellation, c.call("GET", "/api/mem/cancel", url.Values{"id": {strconv.FormatInt(id, 10)}}, nil, cancellation)
+}
+
+//Returns the memory parts held
+func (c *Client) GetActualMemory() (*MemoryReport, error) {
+	report := &MemoryReport{}
+	return report, c.call("GET", "/api/mem/getact", nil, nil, report)
+}
+
+//Returns the memory parts defined by the last request
+func (c *Client) GetDefinedMemory() (*MemoryReport, error) {
+	report := &MemoryReport{}
+	return report, c.call("GET", "/api/mem/getdef", nil, nil, report)
+}
+
+//Returns a memory request
+func (c *Client) GetMemoryRequest(id int64) (*requests.Record, error) {
+	return c.getRequest("/api/mem/requests/", id)
+}
+
+//Returns the memory requests, newest first
+func (c *Client) ListMemoryRequests() ([]requests.Record, error) {
+	var list []requests.Record
+	return list, c.call("GET", "/api/mem/requests", nil, nil, &list)
+}
+
+//Waits until the memory request is done, failed or cancelled
+func (c *Client) WaitMemory(ctx context.Context, id int64) (*requests.Record, error) {
+	return c.wait(ctx, "/api/mem/requests/", id)
+}
+
+//Sets the size of the files to size, like 2Gi, or changes it with a relative size like +256Mi or -1Gi
+func (c *Client) SetDisk(size string, opts DiskOptions) (*Submitted, error) {
+	params := url.Values{"size": {size}}
+	if opts.Content != "" {
+		params.Set("content", opts.Content)
+	}
+	if opts.Ratio > 0 {
+		params.Set("ratio", strconv.FormatUint(opts.Ratio, 10))
+	}
+	if opts.Mode != "" {
+		params.Set("mode", opts.Mode)
+	}
+	if opts.Policy != "" {
+		params.Set("policy", opts.Policy)
+	}
+	setTTL(params, opts.TTL)
+	sub := &Submitted{}
+	return sub, c.call("GET", "/api/disk/set", params, nil, sub)
+}
+
+//Deletes all the files
+func (c *Client) ReleaseDisk(policy string) (*Submitted, error) {
+	params := url.Values{}
+	if policy != "" {
+		params.Set("policy", policy)
+	}
+	sub := &Submitted{}
+	return sub, c.call("GET", "/api/disk/release", params, nil, sub)
+}
+
+//Changes the time to live of the files, counting from now.  0 removes the expiration
+func (c *Client) SetDiskTTL(lifetime time.Duration) (*ttl.Status, error) {
+	status := &ttl.Status{}
+	return status, c.call("GET", "/api/disk/ttl", url.Values{"ttl": {lifetime.String()}}, nil, status)
+}
+
+//Cancels a disk request.  A running request keeps the files created so far
+func (c *Client) CancelDisk(id int64) (*Cancellation, error) {
+	cancellation := &Cancellation{}
+	return cancellation, c.call("GET", "/api/disk/cancel", url.Values{"id": {strconv.FormatInt(id, 10)}}, nil, cancellation)
+}
+
+//Returns the files created
+func (c *Client) GetActualDisk() (*DiskReport, error) {
+	report := &DiskReport{}
+	return report, c.call("GET", "/api/disk/getact", nil, nil, report)
+}
+
+//Returns the files defined by the last request
+func (c *Client) GetDefinedDisk() (*DiskReport, error) {
+	report := &DiskReport{}
+	return report, c.call("GET", "/api/disk/getdef", nil, nil, report)
+}
+
+//Returns a disk request
+func (c *Client) GetDiskRequest(id int64) (*requests.Record, error) {
+	return c.getRequest("/api/disk/requests/", id)
+}
+
+//Returns the disk requests, newest first
+func (c *Client) ListDiskRequests() ([]requests.Record, error) {
+	var list []requests.Record
+	return list, c.call("GET", "/api/disk/requests", nil, nil, &list)
+}
+
+//Waits until the disk request is done, failed or cancelled
+func (c *Client) WaitDisk(ctx context.Context, id int64) (*requests.Record, error) {
+	return c.wait(ctx, "/api/disk/requests/", id)
+}
+
+//Optional parameters of a CPU load request, the zero value is a flat load of 100% with the default number of workers
+type CPUOptions struct {
+	Workers int
+	Percent uint32 //Flat load per worker
+	Profile string //ramp, step, sine or square
+	From uint32
+	To uint32 //0 for the default of the server, 100
+	Steps uint64
+	Period time.Duration
+}
+
+//Response to a CPU load request
+type CPULoad struct {
+	RequestID int64 `json:"request_id"`
+	Time uint64 `json:"time"` //Seconds
+	TimeHuman string `json:"time_human"`
+	Profile string `json:"profile"`
+	Workers int `json:"workers"`
+}
+
+//State of the CPU load in progress
+type CPUStatus struct {
+	RequestID int64 `json:"request_id"`
+	Start time.Time `json:"start"`
+	Time uint64 `json:"time"`
+	End time.Time `json:"end"`
+	Workers int `json:"workers"`
+	ActiveWorkers int `json:"active_workers"`
+	Profile string `json:"profile"`
+	TargetPercent uint32 `json:"target_percent"`
+	AchievedPercent float64 `json:"achieved_percent"`
+	NumberToFactor string `json:"number_to_factor"`
+}
+
+//Starts a CPU load for duration, the server rounds it up to whole seconds
+func (c *Client) StartCPULoad(duration time.Duration, opts CPUOptions) (*CPULoad, error) {
+	params := url.Values{"time": {duration.String()}}
+	if opts.Workers > 0 {
+		params.Set("workers", strconv.Itoa(opts.Workers))
+	}
+	if opts.Percent > 0 {
+		params.Set("percent", strconv.FormatUint(uint64(opts.Percent), 10))
+	}
+	if opts.Profile != "" {
+		params.Set("profile", opts.Profile)
+	}
+	if opts.From > 0 {
+		params.Set("from", strconv.FormatUint(uint64(opts.From), 10))
+	}
+	if opts.To > 0 {
+		params.Set("to", strconv.FormatUint(uint64(opts.To), 10))
+	}
+	if opts.Steps > 0 {
+		params.Set("steps", strconv.FormatUint(opts.Steps, 10))
+	}
+	if opts.Period > 0 {
+		params.Set("period", strconv.FormatInt(int64(opts.Period.Seconds()), 10))
+	}
+	load := &CPULoad{}
+	return load, c.call("GET", "/api/cpu/load", params, nil, load)
+}
+
+//Stops the CPU load with the request ID
+func (c *Client) StopCPULoad(id int64) error {
+	return c.call("GET", "/api/cpu/stop", url.Values{"id": {strconv.FormatInt(id, 10)}}, nil, nil)
+}
+
+//Returns the state of the CPU load in progress.  Returns an error with CodeNoRequest if there is none
+func (c *Client) GetCPULoad() (*CPUStatus, error) {
+	status := &CPUStatus{}
+	return status, c.call("GET", "/api/cpu/getact", nil, nil, status)
+}
+
+//Returns a CPU load request
+func (c *Client) GetCPURequest(id int64) (*requests.Record, error) {
+	return c.getRequest("/api/cpu/requests/", id)
+}
+
+//Returns the CPU load requests, newest first
+func (c *Client) ListCPURequests() ([]requests.Record, error) {
+	var list []requests.Record
+	return list, c.call("GET", "/api/cpu/requests", nil, nil, &list)
+}
+
+//Waits until the CPU load request is done or failed
+func (c *Client) WaitCPU(ctx context.Context, id int64) (*requests.Record, error) {
+	return c.wait(ctx, "/api/cpu/requests/", id)
+}
+
+//Returns the memory and disk limits, with the keys mem and disk
+func (c *Client) GetLimits() (map[string]limits.Report, error) {
+	report := make(map[string]limits.Report)
+	return report, c.call("GET", "/api/limits", nil, nil, &report)
+}
+
+//Overrides the memory and disk limits, with sizes like 4Gi or reset to remove the override.  Empty values are not changed
+func (c *Client) SetLimits(mem string, disk string) (map[string]limits.Report, error) {
+	params := url.Values{}
+	if mem != "" {
+		params.Set("mem", mem)
+	}
+	if disk != "" {
+		params.Set("disk", disk)
+	}
+	report := make(map[string]limits.Report)
+	return report, c.call("GET", "/api/limits/set", params, nil, &report)
+}
+
+//Starts a scenario in YAML or JSON
+func (c *Client) StartScenario(data []byte) error {
+	return c.call("POST", "/api/scenario", nil, data, nil)
+}
+
+//Returns the state of the current or last scenario
+func (c *Client) GetScenario() (*scenario.Status, error) {
+	status := &scenario.Status{}
+	return status, c.call("GET", "/api/scenario/status", nil, nil, status)
+}
+
+//Pauses the running scenario
+func (c *Client) PauseScenario() error {
+	return c.call("GET", "/api/scenario/pause", nil, nil, nil)
+}
+
+//Resumes the paused scenario
+func (c *Client) ResumeScenario() error {
+	return c.call("GET", "/api/scenario/resume", nil, nil, nil)
+}
+
+//Aborts the running or paused scenario
+func (c *Client) AbortScenario() error {
+	return c.call("GET", "/api/scenario/abort", nil, nil, nil)
+}
+
+//Returns a request from the history at prefix
+func (c *Client) getRequest(prefix string, id int64) (*requests.Record, error) {
+	rec := &requests.Record{}
+	return rec, c.call("GET", prefix+strconv.FormatInt(id, 10), nil, nil, rec)
+}
+
+//Interval between checks of the state of a request
+const pollInterval = 1 * time.Second
+
+//Polls the request until it is done, failed or cancelled, or the context is done.  A failed or cancelled request returns the record and an error
+func (c *Client) wait(ctx context.Context, prefix string, id int64) (*requests.Record, error) {
+	for {
+		rec, err := c.getRequest(prefix, id)
+		if err != nil {
+			return nil, err
+		}
+		switch rec.State {
+		case requests.Done:
+			return rec, nil
+		case requests.Failed:
+			return rec, fmt.Errorf("request %d failed: %s", id, rec.Error)
+		case requests.Cancelled:
+			return rec, fmt.Errorf("request %d cancelled: %s", id, rec.Error)
+		}
+		select {
+		case <-ctx.Done():
+			return rec, ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
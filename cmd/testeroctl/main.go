@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/tale-toul/testero/client"
+	"github.com/tale-toul/testero/requests"
+	"github.com/tale-toul/testero/units"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const usage = `Usage: testeroctl [-url URL] [-token TOKEN] <group> <command> [arguments] [options]
+
+  mem set <size> [-fill F] [-policy P] [-ttl D] [-wait]   Set the memory held, like 2Gi, +256Mi or -1Gi
+  mem release [-policy P] [-wait]                         Release all the memory
+  mem ttl <duration>                                      Change the time to live of the memory held
+  mem get | mem def                                       Show the memory parts held or defined
+  mem status <id> | mem requests                          Show a memory request or the list of requests
+  mem cancel <id> [-wait]                                 Cancel a memory request, the parts created are kept
+  disk set <size> [-content C] [-ratio R] [-mode M] [-policy P] [-ttl D] [-wait]
+  disk release | disk ttl | disk get | disk def | disk status | disk requests | disk cancel
+  cpu load <duration> [-workers N] [-percent P] [-profile K -from F -to T -steps S -period D] [-wait]
+  cpu stop <id> | cpu get | cpu status <id> | cpu requests
+  limits get | limits set [-mem SIZE] [-disk SIZE]
+  scenario start <file> | scenario status | scenario pause | scenario resume | scenario abort
+
+The URL and token default to the TESTERO_URL and TESTERO_TOKEN environment variables.
+-wait polls the request until it is done, failed or cancelled, -timeout limits the time waiting.
+Negative sizes like -1Gi are arguments, not options.  Any argument can be passed after -- to keep it from being read as an option.
+`
+
+//Options shared by all the commands
+type options struct {
+	fill, content, mode, policy, profile, mem, disk string
+	ttl, period, timeout time.Duration
+	ratio, steps uint64
+	workers, percent, from, to uint
+	wait bool
+}
+
+func main() {
+	base := os.Getenv("TESTERO_URL")
+	if base == "" {
+		base = "http://localhost:8080"
+	}
+	global := flag.NewFlagSet("testeroctl", flag.ExitOnError)
+	global.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	baseURL := global.String("url", base, "Base URL of testero")
+	token := global.String("token", os.Getenv("TESTERO_TOKEN"), "Bearer token")
+	global.Parse(os.Args[1:])
+
+	var opts options
+	fs := flag.NewFlagSet("command", flag.ExitOnError)
+	fs.Usage = global.Usage
+	fs.StringVar(&opts.fill, "fill", "", "Fill mode of memory parts")
+	fs.StringVar(&opts.content, "content", "", "Content of new files")
+	fs.StringVar(&opts.mode, "mode", "", "Creation mode of new files")
+	fs.StringVar(&opts.policy, "policy", "", "Queueing policy: queue, replace or reject")
+	fs.StringVar(&opts.profile, "profile", "", "CPU load profile")
+	fs.StringVar(&opts.mem, "mem", "", "Memory limit, or reset")
+	fs.StringVar(&opts.disk, "disk", "", "Disk limit, or reset")
+	fs.DurationVar(&opts.ttl, "ttl", 0, "Time to live of the allocation, negative for no expiration")
+	fs.DurationVar(&opts.period, "period", 0, "Period of the CPU load profile")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "Maximum time to wait, 0 for no limit")
+	fs.Uint64Var(&opts.ratio, "ratio", 0, "Compression ratio of random content")
+	fs.Uint64Var(&opts.steps, "steps", 0, "Steps of the CPU load profile")
+	fs.UintVar(&opts.workers, "workers", 0, "Number of CPU load workers")
+	fs.UintVar(&opts.percent, "percent", 0, "Flat CPU load per worker")
+	fs.UintVar(&opts.from, "from", 0, "Initial percentage of the CPU load profile")
+	fs.UintVar(&opts.to, "to", 0, "Final percentage of the CPU load profile")
+	fs.BoolVar(&opts.wait, "wait", false, "Wait until the request is done or failed")
+	args := parseArgs(fs, global.Args())
+	if len(args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cl := client.New(*baseURL, *token)
+	if err := run(cl, args, opts); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+//Parses the options found anywhere in args, so they can follow the positional arguments.  Returns the positional arguments.
+//Arguments starting with a dash and a digit, like the size -1Gi, are positional, not options, and everything after -- is positional
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional, options []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			positional = append(positional, args[i+1:]...)
+			i = len(args)
+		case len(arg) < 2 || arg[0] != '-' || negativeArg(arg):
+			positional = append(positional, arg)
+		default:
+			options = append(options, arg)
+			//The value of the option is the next argument, unless it is a boolean option or the value is written with =
+			name := strings.TrimLeft(arg, "-")
+			if strings.Contains(name, "=") {
+				continue
+			}
+			if f := fs.Lookup(name); f != nil && !isBoolFlag(f) && i+1 < len(args) {
+				i++
+				options = append(options, args[i])
+			}
+		}
+	}
+	fs.Parse(options)
+	return append(positional, fs.Args()...)
+}
+
+//Returns true if the option does not take a value, like -wait
+func isBoolFlag(f *flag.Flag) bool {
+	bf, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && bf.IsBoolFlag()
+}
+
+//Returns true if the argument is a negative number or size, like -1Gi
+func negativeArg(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-' && arg[1] >= '0' && arg[1] <= '9'
+}
+
+//Runs the command
+func run(cl *client.Client, args []string, opts options) error {
+	group, command, params := args[0], args[1], args[2:]
+	switch group + " " + command {
+	case "mem set", "disk set":
+		if len(params) != 1 {
+			return fmt.Errorf("%s set requires a size", group)
+		}
+		var sub *client.Submitted
+		var err error
+		if group == "mem" {
+			sub, err = cl.SetMemory(params[0], client.MemoryOptions{Fill: opts.fill, Policy: opts.policy, TTL: opts.ttl})
+		} else {
+			sub, err = cl.SetDisk(params[0], client.DiskOptions{Content: opts.content, Ratio: opts.ratio, Mode: opts.mode, Policy: opts.policy, TTL: opts.ttl})
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request %d %s for %s, %s\n", sub.RequestID, sub.Operation, sub.SizeHuman, sub.State)
+		return waitRequest(cl, group, sub.RequestID, opts)
+	case "mem release", "disk release":
+		var sub *client.Submitted
+		var err error
+		if group == "mem" {
+			sub, err = cl.ReleaseMemory(opts.policy)
+		} else {
+			sub, err = cl.ReleaseDisk(opts.policy)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request %d release, %s\n", sub.RequestID, sub.State)
+		return waitRequest(cl, group, sub.RequestID, opts)
+	case "mem ttl", "disk ttl":
+		if len(params) != 1 {
+			return fmt.Errorf("%s ttl requires a duration", group)
+		}
+		lifetime, err := units.ParseDuration(params[0])
+		if err != nil {
+			return err
+		}
+		if group == "mem" {
+			return printResult(cl.SetMemoryTTL(lifetime))
+		}
+		return printResult(cl.SetDiskTTL(lifetime))
+	case "mem cancel", "disk cancel":
+		id, err := parseID(params)
+		if err != nil {
+			return err
+		}
+		var cancellation *client.Cancellation
+		if group == "mem" {
+			cancellation, err = cl.CancelMemory(id)
+		} else {
+			cancellation, err = cl.CancelDisk(id)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request %d cancel requested, %s\n", id, cancellation.State)
+		err = waitRequest(cl, group, id, opts)
+		if err != nil {
+			//Ending in the cancelled state is the expected outcome
+			if rec, errg := getRequest(cl, group, id); errg == nil && rec.State == requests.Cancelled {
+				return nil
+			}
+		}
+		return err
+	case "mem get":
+		return printResult(cl.GetActualMemory())
+	case "mem def":
+		return printResult(cl.GetDefinedMemory())
+	case "disk get":
+		return printResult(cl.GetActualDisk())
+	case "disk def":
+		return printResult(cl.GetDefinedDisk())
+	case "mem requests":
+		return printResult(cl.ListMemoryRequests())
+	case "disk requests":
+		return printResult(cl.ListDiskRequests())
+	case "cpu requests":
+		return printResult(cl.ListCPURequests())
+	case "mem status", "disk status", "cpu status":
+		id, err := parseID(params)
+		if err != nil {
+			return err
+		}
+		return printResult(getRequest(cl, group, id))
+	case "cpu load":
+		if len(params) != 1 {
+			return fmt.Errorf("cpu load requires a duration")
+		}
+		duration, err := units.ParseDuration(params[0])
+		if err != nil {
+			return err
+		}
+		load, err := cl.StartCPULoad(duration, client.CPUOptions{Workers: int(opts.workers), Percent: uint32(opts.percent),
+			Profile: opts.profile, From: uint32(opts.from), To: uint32(opts.to), Steps: opts.steps, Period: opts.period})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Request %d CPU load for %s, %s, with %d workers\n", load.RequestID, load.TimeHuman, load.Profile, load.Workers)
+		return waitRequest(cl, group, load.RequestID, opts)
+	case "cpu stop":
+		id, err := parseID(params)
+		if err != nil {
+			return err
+		}
+		if err = cl.StopCPULoad(id); err != nil {
+			return err
+		}
+		fmt.Printf("CPU load %d stopped\n", id)
+		return nil
+	case "cpu get":
+		return printResult(cl.GetCPULoad())
+	case "limits get":
+		return printResult(cl.GetLimits())
+	case "limits set":
+		return printResult(cl.SetLimits(opts.mem, opts.disk))
+	case "scenario start":
+		if len(params) != 1 {
+			return fmt.Errorf("scenario start requires a file")
+		}
+		data, err := ioutil.ReadFile(params[0])
+		if err != nil {
+			return err
+		}
+		if err = cl.StartScenario(data); err != nil {
+			return err
+		}
+		return printResult(cl.GetScenario())
+	case "scenario status":
+		return printResult(cl.GetScenario())
+	case "scenario pause":
+		return cl.PauseScenario()
+	case "scenario resume":
+		return cl.ResumeScenario()
+	case "scenario abort":
+		return cl.AbortScenario()
+	}
+	return fmt.Errorf("unknown command: %s %s", group, command)
+}
+
+//Gets the request ID from the arguments
+func parseID(params []string) (int64, error) {
+	if len(params) != 1 {
+		return 0, fmt.Errorf("a request ID is required")
+	}
+	return strconv.ParseInt(params[0], 10, 64)
+}
+
+//Gets a request of the group
+func getRequest(cl *client.Client, group string, id int64) (*requests.Record, error) {
+	switch group {
+	case "mem":
+		return cl.GetMemoryRequest(id)
+	case "disk":
+		return cl.GetDiskRequest(id)
+	}
+	return cl.GetCPURequest(id)
+}
+
+//Waits for the request if the wait option is set
+func waitRequest(cl *client.Client, group string, id int64, opts options) error {
+	if !opts.wait {
+		return nil
+	}
+	ctx := context.Background()
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	var rec *requests.Record
+	var err error
+	switch group {
+	case "mem":
+		rec, err = cl.WaitMemory(ctx, id)
+	case "disk":
+		rec, err = cl.WaitDisk(ctx, id)
+	default:
+		rec, err = cl.WaitCPU(ctx, id)
+	}
+	if rec != nil {
+		fmt.Print(rec)
+	}
+	return err
+}
+
+//Prints the result of a query as indented JSON
+func printResult(result interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		positional []string
+		ttl time.Duration
+		wait bool
+	}{
+		{[]string{"mem", "set", "2Gi"}, []string{"mem", "set", "2Gi"}, 0, false},
+		{[]string{"mem", "set", "-1Gi"}, []string{"mem", "set", "-1Gi"}, 0, false},
+		{[]string{"mem", "set", "-1Gi", "-wait"}, []string{"mem", "set", "-1Gi"}, 0, true},
+		{[]string{"-wait", "disk", "set", "+512Mi", "-ttl", "1h"}, []string{"disk", "set", "+512Mi"}, time.Hour, true},
+		{[]string{"mem", "set", "-ttl", "-1s", "-5M"}, []string{"mem", "set", "-5M"}, -time.Second, false},
+		{[]string{"mem", "set", "--", "-1Gi"}, []string{"mem", "set", "-1Gi"}, 0, false},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		ttl := fs.Duration("ttl", 0, "")
+		wait := fs.Bool("wait", false, "")
+		positional := parseArgs(fs, tt.args)
+		if !reflect.DeepEqual(positional, tt.positional) || *ttl != tt.ttl || *wait != tt.wait {
+			t.Errorf("parseArgs(%q) = %q, ttl %s, wait %t, want %q, ttl %s, wait %t", tt.args, positional, *ttl, *wait, tt.positional, tt.ttl, tt.wait)
+		}
+	}
+}
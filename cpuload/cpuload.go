@@ -1,55 +1,152 @@
 package cpuload
 
 import (
+	"context"
 	"fmt"
+	"github.com/tale-toul/testero/cgroup"
 	"log"
 	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+//Length of a busy+sleep cycle for loads below 100%
+const dutyPeriod = 100 * time.Millisecond
+//Number of factoring iterations between checks of the duty cycle clock
+const dutyCheck = 1000
+
 //Contains information about the CPU load task
 type CpuCollection struct {
 	clid int64  //Request ID corresponds to the Unix time when the request was sent
 	lapse uint64 //Request load time in seconds
 	bfn *big.Int //Number to factor
+	workers []*worker //Factoring workers of the current or last request
+	percent uint32 //Current target load per worker in percent of a CPU, accessed atomically
+	profile LoadProfile //How the target load changes during the request
+	cpuStart time.Duration //Process CPU time when the load started
+	wallStart time.Time //Wall clock time when the load started
+	mutex *sync.Mutex //Protects the request fields and workers while a new request replaces them
+}
+
+//State of a single factoring goroutine
+type worker struct {
+	wid int //Worker number within the request
+	running int32 //1 while the worker is factoring, accessed atomically
 }
 
 //Locking and communication channels
 var foundFactors chan []*big.Int
 var quit chan bool
+//Protects quit from being closed twice
+var quitMutex sync.Mutex
+
+//Get latest request ID
+func (cc *CpuCollection) GetID() int64 {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.clid
+}
 
 //Get latest request load time
-func (cc CpuCollection) GetDuration() uint64 {
+func (cc *CpuCollection) GetDuration() uint64 {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
 	return cc.lapse
 }
 
 //Get time when the request was made
-func (cc CpuCollection) GetReqTime() time.Time {
-	tsecs := cc.clid / 1000000000 
+func (cc *CpuCollection) GetReqTime() time.Time {
+	tsecs := cc.GetID() / 1000000000 
 	return time.Unix(tsecs,0)
 }
 
+//Get the load profile of the latest request
+func (cc *CpuCollection) GetProfile() LoadProfile {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.profile
+}
+
+//Get the current target load per worker in percent of a CPU
+func (cc *CpuCollection) GetPercent() uint32 {
+	return atomic.LoadUint32(&cc.percent)
+}
+
+//Get the load achieved since the request started, in percent of a single CPU, measured from the process's own CPU time
+func (cc *CpuCollection) GetAchievedLoad() float64 {
+	cc.mutex.Lock()
+	wallStart, cpuStart := cc.wallStart, cc.cpuStart
+	cc.mutex.Unlock()
+	wall := time.Since(wallStart)
+	if wall <= 0 {
+		return 0
+	}
+	return float64(processCpuTime()-cpuStart) / float64(wall) * 100
+}
+
+//Get the user plus system CPU time consumed by this process
+func processCpuTime() time.Duration {
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		log.Printf("cpuload.processCpuTime(): Error getting resource usage: %s", err.Error())
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+//Get the number of workers started by the latest request
+func (cc *CpuCollection) GetWorkers() int {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return len(cc.workers)
+}
+
+//Get the number of workers that are still factoring
+func (cc *CpuCollection) GetActiveWorkers() int {
+	cc.mutex.Lock()
+	workers := cc.workers
+	cc.mutex.Unlock()
+	var active int
+	for _,w := range workers {
+		if atomic.LoadInt32(&w.running) == 1 {
+			active++
+		}
+	}
+	return active
+}
+
 //Initialize a CpuCollection object
 func (cc *CpuCollection) NewCc(numtofactor string) {
 	var bigSuccess bool
 
 	cc.clid = 0 //To make it explicit
+	cc.mutex = &sync.Mutex{}
 	cc.bfn, bigSuccess = new(big.Int).SetString(numtofactor, 10)
 	if !bigSuccess  {
 		panic("Invalid number to factor: NUMTOFACTOR="+ numtofactor)
 	}
 }
 
-//Start a timer and launch the load generator, wait for the quickest to end
-func LoadUp(cS *CpuCollection, ts int64, duration uint64, lock chan int64) {
+//Start a timer and launch the load generators, wait for the timer or all the workers to end
+//profile defines the load each worker should keep over time.  The load stops early if ctx is cancelled.
+//Returns an error if the load could not be started
+func LoadUp(ctx context.Context, cS *CpuCollection, ts int64, duration uint64, nworkers int, profile LoadProfile, lock chan int64) error {
 	select {
 	case <- time.After(5 * time.Second): //If 5 seconds pass without getting the proper lock, abort
 		log.Printf("cpuload.LoadUp(): timeout waiting for lock")
-		return
+		return fmt.Errorf("timeout waiting for lock")
 	case chts := <- lock:
 		if chts == ts { //Got the lock and if it matches the timestamp received, proceed
+			cS.mutex.Lock()
 			cS.clid = ts
 			cS.lapse = duration
+			cS.profile = profile
+			cS.mutex.Unlock()
+			atomic.StoreUint32(&cS.percent, profile.At(0, time.Duration(duration)*time.Second))
 			defer func(){
 				lock <- 0 //Release lock
 			}()
@@ -57,25 +154,101 @@ func LoadUp(cS *CpuCollection, ts int64, duration uint64, lock chan int64) {
 		} else {
 			log.Printf("cpuload.LoadUp(): lock obtained, but timestamps missmatch: %d - %d\n", ts,chts)
 			lock <- chts
-			return
+			return fmt.Errorf("lock obtained, but timestamps missmatch: %d - %d", ts, chts)
 		}
 	}
 	var returnedFactors []*big.Int
-	foundFactors = make(chan []*big.Int,1)
-	quit = make(chan bool,1)
-	log.Printf("Load CPU for %d seconds factoring number: %d", duration,cS.bfn)
-	go factor(cS.bfn)
+	foundFactors = make(chan []*big.Int,nworkers)
+	quitMutex.Lock()
+	quit = make(chan bool)
+	quitMutex.Unlock()
+	workers := make([]*worker,nworkers)
+	for i := range workers {
+		workers[i] = &worker{wid: i, running: 1}
+	}
+	log.Printf("Load CPU for %d seconds, %s, with %d workers factoring number: %d", duration,profile,nworkers,cS.bfn)
+	wallStart := time.Now()
+	cS.mutex.Lock()
+	cS.workers = workers
+	cS.cpuStart = processCpuTime()
+	cS.wallStart = wallStart
+	cS.mutex.Unlock()
+	for _, w := range workers {
+		//Every worker gets its own copy of the number because factor() modifies it
+		go factor(cS, w, new(big.Int).Set(cS.bfn))
+	}
+	timeout := time.After(time.Duration(duration) * time.Second)
+	done := ctx.Done()
+	//Move the target load along the profile
+	tick := time.NewTicker(dutyPeriod)
+	defer tick.Stop()
+	for pending := nworkers; pending > 0; {
+		select {
+		case <- tick.C:
+			atomic.StoreUint32(&cS.percent, profile.At(time.Since(wallStart), time.Duration(duration)*time.Second))
+		case <- timeout:
+			log.Printf("CPU high load for %d seconds elapsed",duration)
+			haltWorkers()
+			timeout = nil //Don't fire again while waiting for the workers to return
+		case <- done:
+			log.Printf("cpuload.LoadUp(): Request %d cancelled: %s", ts, ctx.Err())
+			haltWorkers()
+			done = nil
+		case returnedFactors = <-foundFactors:
+			pending--
+			log.Printf("Factors found: %v", returnedFactors)
+		}
+	}
+	return nil
+}
+
+//Tell every worker to stop factoring. Safe to call more than once
+func haltWorkers() {
+	quitMutex.Lock()
+	defer quitMutex.Unlock()
+	if quit == nil { //No load request has been started yet
+		return
+	}
+	select {
+	case <-quit: //Already closed
+	default:
+		close(quit)
+	}
+}
+
+//Get the default number of workers: the CPU quota of the container's cgroup if there is one,
+//otherwise the number of CPUs in the system
+func DefaultWorkers() int {
+	ncpu := runtime.NumCPU()
+	quota, _ := cgroup.CpuQuota()
+	if quota > 0 && quota < ncpu {
+		return quota
+	}
+	return ncpu
+}
+
+//Keeps the worker busy for the target percent of every duty period, and sleeps the rest.
+//Returns false if the worker was told to quit while sleeping
+func dutyCycle(cS *CpuCollection, sliceStart *time.Time) bool {
+	busy := dutyPeriod * time.Duration(cS.GetPercent()) / 100
+	if busy >= dutyPeriod || time.Since(*sliceStart) < busy {
+		return true
+	}
 	select {
-	case <- time.After(time.Duration(duration) * time.Second):
-		log.Printf("CPU high load for %d seconds elapsed",duration)
-		quit <- true
-	case returnedFactors = <-foundFactors:
-		log.Printf("Factors found: %v", returnedFactors)
+	case <-quit:
+		return false
+	case <-time.After(dutyPeriod - busy):
+		*sliceStart = time.Now()
+		return true
 	}
 }
 
 // Finds the factors of inNum
-func factor(inNum *big.Int) {
+func factor(cS *CpuCollection, w *worker, inNum *big.Int) {
+	defer atomic.StoreInt32(&w.running, 0)
+	//Start of the current duty cycle and iterations since the last check
+	sliceStart := time.Now()
+	var iter int
 	//Candidate factors
 	c := big.NewInt(2)
 	//List of found factors
@@ -112,10 +285,16 @@ func factor(inNum *big.Int) {
 	for c.Cmp(topc) != 1  {   // While c <= topc
 		select {
 		case <-quit:
-			log.Printf("cpuload.Factor(): Quiting early, external signal")
+			log.Printf("cpuload.Factor(): Worker %d quiting early, external signal",w.wid)
 			foundFactors <- outFactors
 			return
 		default: //Keep factoring
+			iter++
+			if iter%dutyCheck == 0 && !dutyCycle(cS, &sliceStart) {
+				log.Printf("cpuload.Factor(): Worker %d quiting early while idle, external signal",w.wid)
+				foundFactors <- outFactors
+				return
+			}
 			tempDm, modulus = tempDm.DivMod(inNum, c, modulus)
 			if modulus.Cmp(zero) == 0 {
 				outFactors = append(outFactors, new(big.Int).Set(c))
@@ -131,14 +310,14 @@ func factor(inNum *big.Int) {
 }
 
 //Stops the current factoring of a number if the ID requested match
-func StopLoad(cS CpuCollection, id int64) string {
-	if id != cS.clid { //IDs don't match, go away
-		log.Printf("cpuload.StopLoad(): Stop request ID (%d) does not match last load request ID (%d)",id,cS.clid)
+func StopLoad(cS *CpuCollection, id int64) string {
+	if clid := cS.GetID(); id != clid { //IDs don't match, go away
+		log.Printf("cpuload.StopLoad(): Stop request ID (%d) does not match last load request ID (%d)",id,clid)
 		time.Sleep(1 * time.Second)
 		return fmt.Sprintf("Incorrect stop load request ID=%d\n",id)
 	} else { //IDs match
 		log.Printf("cpuload.StopLoad(): IDs match, stoping CPU load")
-		quit <- true
+		haltWorkers()
 		return fmt.Sprintf("CPU load stopped\n")
 	}
 }
\ No newline at end of file
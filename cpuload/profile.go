@@ -0,0 +1,82 @@
+package cpuload
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+//Shape of the CPU load over the duration of a request
+type LoadProfile struct {
+	kind string //flat, ramp, step, sine or square
+	from uint32 //Load at the start of the profile, in percent
+	to uint32 //Load at the end of the profile or the high point of a wave, in percent
+	steps uint64 //Number of levels of a step profile
+	period time.Duration //Period of a sine or square wave
+}
+
+//Creates a load profile and checks its parameters are consistent
+//kind is one of flat, ramp, step, sine or square; a flat profile only uses the from value
+func NewProfile(kind string, from uint32, to uint32, steps uint64, period time.Duration) (LoadProfile, error) {
+	lp := LoadProfile{kind: kind, from: from, to: to, steps: steps, period: period}
+	if from > 100 || to > 100 {
+		return lp, fmt.Errorf("Load percentages must be between 0 and 100: from=%d, to=%d", from, to)
+	}
+	switch kind {
+	case "flat":
+		lp.to = from
+	case "ramp":
+	case "step":
+		if steps < 2 {
+			return lp, fmt.Errorf("A step profile requires at least 2 steps: steps=%d", steps)
+		}
+	case "sine", "square":
+		if period <= 0 {
+			return lp, fmt.Errorf("A %s profile requires a period greater than 0", kind)
+		}
+	default:
+		return lp, fmt.Errorf("Unknown load profile: %s", kind)
+	}
+	return lp, nil
+}
+
+//Computes the target load in percent at the elapsed time of a request lasting duration
+func (lp LoadProfile) At(elapsed time.Duration, duration time.Duration) uint32 {
+	var frac float64 //Position in the profile between 0 and 1
+	span := float64(lp.to) - float64(lp.from)
+	switch lp.kind {
+	case "ramp":
+		if duration > 0 {
+			frac = math.Min(float64(elapsed)/float64(duration), 1)
+		}
+	case "step":
+		if duration > 0 {
+			level := uint64(float64(elapsed) / float64(duration) * float64(lp.steps))
+			if level >= lp.steps {
+				level = lp.steps - 1
+			}
+			frac = float64(level) / float64(lp.steps-1)
+		}
+	case "sine": //Starts at the low point and reaches the high point half way through the period
+		frac = (1 - math.Cos(2*math.Pi*float64(elapsed)/float64(lp.period))) / 2
+	case "square": //Low during the first half of every period, high during the second
+		if elapsed%lp.period >= lp.period/2 {
+			frac = 1
+		}
+	}
+	return uint32(math.Round(float64(lp.from) + span*frac))
+}
+
+//Describes the profile in a human readable way
+func (lp LoadProfile) String() string {
+	switch lp.kind {
+	case "flat":
+		return fmt.Sprintf("flat at %d%%", lp.from)
+	case "ramp":
+		return fmt.Sprintf("ramp from %d%% to %d%%", lp.from, lp.to)
+	case "step":
+		return fmt.Sprintf("%d steps from %d%% to %d%%", lp.steps, lp.from, lp.to)
+	default:
+		return fmt.Sprintf("%s wave between %d%% and %d%% with period %v", lp.kind, lp.from, lp.to, lp.period)
+	}
+}
@@ -0,0 +1,73 @@
+package cpuload
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewProfile(t *testing.T) {
+	tests := []struct {
+		kind string
+		from, to uint32
+		steps uint64
+		period time.Duration
+		fail bool
+	}{
+		{"flat", 50, 0, 0, 0, false},
+		{"ramp", 10, 90, 0, 0, false},
+		{"step", 10, 90, 4, 0, false},
+		{"step", 10, 90, 1, 0, true},
+		{"sine", 10, 90, 0, time.Minute, false},
+		{"square", 10, 90, 0, 0, true},
+		{"ramp", 10, 101, 0, 0, true},
+		{"saw", 10, 90, 0, time.Minute, true},
+	}
+	for _, tt := range tests {
+		_, err := NewProfile(tt.kind, tt.from, tt.to, tt.steps, tt.period)
+		if (err != nil) != tt.fail {
+			t.Errorf("NewProfile(%s, %d, %d, %d, %s) = %v, want fail %t", tt.kind, tt.from, tt.to, tt.steps, tt.period, err, tt.fail)
+		}
+	}
+}
+
+func TestLoadProfileAt(t *testing.T) {
+	duration := 100 * time.Second
+	tests := []struct {
+		kind string
+		from, to uint32
+		steps uint64
+		period time.Duration
+		elapsed time.Duration
+		load uint32
+	}{
+		{"flat", 60, 0, 0, 0, 0, 60},
+		{"flat", 60, 0, 0, 0, 90 * time.Second, 60},
+		{"ramp", 10, 90, 0, 0, 0, 10},
+		{"ramp", 10, 90, 0, 0, 50 * time.Second, 50},
+		{"ramp", 10, 90, 0, 0, 100 * time.Second, 90},
+		{"ramp", 10, 90, 0, 0, 150 * time.Second, 90},
+		{"ramp", 90, 10, 0, 0, 25 * time.Second, 70},
+		{"step", 10, 70, 4, 0, 0, 10},
+		{"step", 10, 70, 4, 0, 24 * time.Second, 10},
+		{"step", 10, 70, 4, 0, 25 * time.Second, 30},
+		{"step", 10, 70, 4, 0, 60 * time.Second, 50},
+		{"step", 10, 70, 4, 0, 99 * time.Second, 70},
+		{"step", 10, 70, 4, 0, 120 * time.Second, 70},
+		{"sine", 20, 80, 0, 40 * time.Second, 0, 20},
+		{"sine", 20, 80, 0, 40 * time.Second, 10 * time.Second, 50},
+		{"sine", 20, 80, 0, 40 * time.Second, 20 * time.Second, 80},
+		{"sine", 20, 80, 0, 40 * time.Second, 40 * time.Second, 20},
+		{"square", 20, 80, 0, 40 * time.Second, 19 * time.Second, 20},
+		{"square", 20, 80, 0, 40 * time.Second, 20 * time.Second, 80},
+		{"square", 20, 80, 0, 40 * time.Second, 45 * time.Second, 20},
+	}
+	for _, tt := range tests {
+		lp, err := NewProfile(tt.kind, tt.from, tt.to, tt.steps, tt.period)
+		if err != nil {
+			t.Fatalf("NewProfile(%s): %v", tt.kind, err)
+		}
+		if load := lp.At(tt.elapsed, duration); load != tt.load {
+			t.Errorf("%s.At(%s) = %d, want %d", lp, tt.elapsed, load, tt.load)
+		}
+	}
+}
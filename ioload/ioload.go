@@ -0,0 +1,453 @@
+package ioload
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+//Alignment required for the buffers and offsets used with O_DIRECT
+const alignment = 4096
+//Size of the chunks written when the work file is created
+const fillChunk = 1048576
+//Name of the work file, created in the directory given to NewIc
+const WorkFileName = "io-data"
+//Number of histogram buckets per power of two of microseconds
+const bucketsPerPow = 8
+//Number of histogram buckets, enough for latencies of more than an hour
+const numBuckets = 36 * bucketsPerPow
+
+//Kinds of I/O load
+const (
+	SeqRead = "seqread"
+	SeqWrite = "seqwrite"
+	RandRead = "randread"
+	RandWrite = "randwrite"
+)
+
+//Parameters of an I/O load request
+type IoParams struct {
+	Mode string //One of SeqRead, SeqWrite, RandRead or RandWrite
+	BlockSize uint64 //Bytes per operation
+	IoDepth int //Number of concurrent workers, each one with a single operation in flight
+	Rate uint64 //Target operations per second for all the workers together, 0 means unlimited
+	Duration uint64 //Load time in seconds
+	FileSize uint64 //Size of the work file in bytes
+	Direct bool //Open the work file with O_DIRECT to bypass the page cache
+	Fsync bool //Call fsync after every write
+}
+
+//Convert a block size like 4096, 4k or 1m into a number of bytes
+func ParseBlockSize(bs string) (uint64, error) {
+	var mult uint64 = 1
+	if bs == "" {
+		return 0, fmt.Errorf("Empty block size")
+	}
+	switch strings.ToLower(bs[len(bs)-1:]) {
+	case "k":
+		mult = 1024
+	case "m":
+		mult = 1048576
+	}
+	if mult > 1 {
+		bs = bs[:len(bs)-1]
+	}
+	size, err := strconv.ParseUint(bs, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return size * mult, nil
+}
+
+//Check the parameters are consistent
+func (ip IoParams) Validate() error {
+	switch ip.Mode {
+	case SeqRead, SeqWrite, RandRead, RandWrite:
+	default:
+		return fmt.Errorf("Invalid I/O mode: %s, valid modes are: seqread, seqwrite, randread, randwrite", ip.Mode)
+	}
+	if ip.BlockSize == 0 || ip.BlockSize > ip.FileSize {
+		return fmt.Errorf("Block size must be greater than 0 and not bigger than the work file: bs=%d, file size=%d", ip.BlockSize, ip.FileSize)
+	}
+	if ip.Direct && ip.BlockSize%alignment != 0 {
+		return fmt.Errorf("Block size must be a multiple of %d bytes with direct I/O: bs=%d", alignment, ip.BlockSize)
+	}
+	if ip.IoDepth <= 0 {
+		return fmt.Errorf("I/O depth must be greater than 0: iodepth=%d", ip.IoDepth)
+	}
+	return nil
+}
+
+//Contains information about the I/O load task
+type IoCollection struct {
+	ilid int64 //Request ID corresponds to the Unix time when the request was sent
+	params IoParams //Parameters of the latest request
+	workfile string //File where the I/O operations are done
+	start time.Time //When the load started
+	workers []*ioStats //Statistics of every worker
+	quit chan bool //Closed to tell the workers to stop
+	mutex *sync.Mutex //Protects quit from being closed twice, and workers and start while they are replaced
+}
+
+//Operations, bytes and latency histogram of a single worker
+type ioStats struct {
+	mutex sync.Mutex
+	ops uint64
+	bytes uint64
+	errors uint64
+	maxLat time.Duration
+	hist [numBuckets]uint64
+}
+
+//Add an operation to the statistics
+func (st *ioStats) record(lat time.Duration, nbytes int) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.ops++
+	st.bytes += uint64(nbytes)
+	st.hist[bucket(lat)]++
+	if lat > st.maxLat {
+		st.maxLat = lat
+	}
+}
+
+//Get the histogram bucket for a latency.  Buckets grow exponentially so the relative error is constant
+func bucket(lat time.Duration) int {
+	us := float64(lat) / float64(time.Microsecond)
+	if us < 1 {
+		return 0
+	}
+	b := int(math.Log2(us)*bucketsPerPow) + 1
+	if b >= numBuckets {
+		return numBuckets - 1
+	}
+	return b
+}
+
+//Get the upper latency limit of a histogram bucket
+func bucketLimit(b int) time.Duration {
+	return time.Duration(math.Exp2(float64(b)/bucketsPerPow) * float64(time.Microsecond))
+}
+
+//Initialize an IoCollection object.  The work file is created in directory
+func (ic *IoCollection) NewIc(directory string) {
+	ic.ilid = 0
+	ic.workfile = directory + "/" + WorkFileName
+	ic.mutex = &sync.Mutex{}
+}
+
+//Get the path of the work file
+func (ic *IoCollection) GetWorkFile() string {
+	return ic.workfile
+}
+
+//Information about the current or last load request, used in reports
+type Report struct {
+	RequestID int64 `json:"request_id"`
+	Start time.Time `json:"start"`
+	Mode string `json:"mode"`
+	BlockSize uint64 `json:"block_size"`
+	IoDepth int `json:"iodepth"`
+	Direct bool `json:"direct"`
+	Fsync bool `json:"fsync"`
+	Rate uint64 `json:"rate"` //Target IOPS, 0 means unlimited
+	Time uint64 `json:"time"` //Load time requested in seconds
+	Elapsed float64 `json:"elapsed_seconds"`
+	Operations uint64 `json:"operations"`
+	Bytes uint64 `json:"bytes"`
+	Errors uint64 `json:"errors"`
+	IOPS float64 `json:"iops"`
+	MBps float64 `json:"mb_per_second"`
+	LatencyP50 time.Duration `json:"latency_p50_ns"`
+	LatencyP90 time.Duration `json:"latency_p90_ns"`
+	LatencyP99 time.Duration `json:"latency_p99_ns"`
+	LatencyP999 time.Duration `json:"latency_p999_ns"`
+	LatencyMax time.Duration `json:"latency_max_ns"`
+}
+
+//Get information about the current or last load request.  Returns false if no request has been processed yet
+func (ic *IoCollection) GetActLoad() (Report, bool) {
+	ic.mutex.Lock()
+	id := ic.ilid
+	ip := ic.params
+	workers := ic.workers
+	start := ic.start
+	ic.mutex.Unlock()
+	if id == 0 {
+		return Report{}, false
+	}
+	var total ioStats
+	for _, st := range workers {
+		st.mutex.Lock()
+		total.ops += st.ops
+		total.bytes += st.bytes
+		total.errors += st.errors
+		if st.maxLat > total.maxLat {
+			total.maxLat = st.maxLat
+		}
+		for b := range st.hist {
+			total.hist[b] += st.hist[b]
+		}
+		st.mutex.Unlock()
+	}
+	elapsed := time.Since(start)
+	if elapsed > time.Duration(ip.Duration)*time.Second {
+		elapsed = time.Duration(ip.Duration) * time.Second
+	}
+	rep := Report{RequestID: id, Start: time.Unix(0, id).Truncate(time.Second), Mode: ip.Mode, BlockSize: ip.BlockSize, IoDepth: ip.IoDepth,
+		Direct: ip.Direct, Fsync: ip.Fsync, Rate: ip.Rate, Time: ip.Duration, Elapsed: elapsed.Seconds(),
+		Operations: total.ops, Bytes: total.bytes, Errors: total.errors,
+		LatencyP50: total.percentile(50), LatencyP90: total.percentile(90), LatencyP99: total.percentile(99), LatencyP999: total.percentile(99.9), LatencyMax: total.maxLat}
+	if rep.Elapsed > 0 {
+		rep.IOPS = float64(total.ops) / rep.Elapsed
+		rep.MBps = float64(total.bytes) / 1048576 / rep.Elapsed
+	}
+	return rep, true
+}
+
+//Generate a message with the information of the report
+func (rep Report) String() string {
+	mensj := fmt.Sprintf("Last request ID: %d\n", rep.RequestID)
+	mensj += fmt.Sprintf("Load request sent at: %v\n", rep.Start)
+	mensj += fmt.Sprintf("Mode: %s, block size: %d bytes, iodepth: %d, direct: %t, fsync: %t\n", rep.Mode, rep.BlockSize, rep.IoDepth, rep.Direct, rep.Fsync)
+	if rep.Rate > 0 {
+		mensj += fmt.Sprintf("Target rate: %d IOPS\n", rep.Rate)
+	} else {
+		mensj += "Target rate: unlimited\n"
+	}
+	mensj += fmt.Sprintf("Load time requested: %d seconds, elapsed: %d seconds\n", rep.Time, int64(rep.Elapsed))
+	mensj += fmt.Sprintf("Operations: %d, bytes: %d, errors: %d\n", rep.Operations, rep.Bytes, rep.Errors)
+	if rep.Elapsed > 0 {
+		mensj += fmt.Sprintf("Achieved: %.1f IOPS, %.2f MB/s\n", rep.IOPS, rep.MBps)
+	}
+	mensj += fmt.Sprintf("Latency p50: %v, p90: %v, p99: %v, p99.9: %v, max: %v\n",
+		rep.LatencyP50, rep.LatencyP90, rep.LatencyP99, rep.LatencyP999, rep.LatencyMax)
+	return mensj
+}
+
+//Estimate a latency percentile from the histogram
+func (st *ioStats) percentile(pct float64) time.Duration {
+	if st.ops == 0 {
+		return 0
+	}
+	threshold := uint64(math.Ceil(float64(st.ops) * pct / 100))
+	var count uint64
+	for b, n := range st.hist {
+		count += n
+		if count >= threshold {
+			if limit := bucketLimit(b); limit < st.maxLat {
+				return limit
+			}
+			return st.maxLat
+		}
+	}
+	return st.maxLat
+}
+
+//Start a timer and launch the I/O workers, wait for the timer to end or a stop request
+func LoadUp(iS *IoCollection, ts int64, ip IoParams, lock chan int64) {
+	select {
+	case <-time.After(5 * time.Second): //If 5 seconds pass without getting the proper lock, abort
+		log.Printf("ioload.LoadUp(): timeout waiting for lock")
+		return
+	case chts := <-lock:
+		if chts == ts { //Got the lock and if it matches the timestamp received, proceed
+			defer func() {
+				lock <- 0 //Release lock
+			}()
+			log.Printf("ioload.LoadUp(): lock obtained, timestamps match: %d\n", ts)
+		} else {
+			log.Printf("ioload.LoadUp(): lock obtained, but timestamps missmatch: %d - %d\n", ts, chts)
+			lock <- chts
+			return
+		}
+	}
+	workers := make([]*ioStats, ip.IoDepth)
+	for i := range workers {
+		workers[i] = &ioStats{}
+	}
+	iS.mutex.Lock()
+	iS.ilid = ts
+	iS.params = ip
+	iS.quit = make(chan bool)
+	iS.workers = workers
+	iS.start = time.Now()
+	iS.mutex.Unlock()
+	err := prepareFile(iS.workfile, ip.FileSize)
+	if err != nil {
+		log.Printf("ioload.LoadUp(): Error preparing work file %s: %s", iS.workfile, err.Error())
+		return
+	}
+	log.Printf("I/O load for %d seconds, mode %s, block size %d, iodepth %d", ip.Duration, ip.Mode, ip.BlockSize, ip.IoDepth)
+	iS.mutex.Lock()
+	iS.start = time.Now() //Don't count the time spent creating the work file
+	iS.mutex.Unlock()
+	var wg sync.WaitGroup
+	for i := 0; i < ip.IoDepth; i++ {
+		wg.Add(1)
+		go func(wid int) {
+			defer wg.Done()
+			ioWorker(iS, wid)
+		}(i)
+	}
+	select {
+	case <-time.After(time.Duration(ip.Duration) * time.Second):
+		log.Printf("I/O load for %d seconds elapsed", ip.Duration)
+		iS.haltWorkers()
+	case <-iS.quit:
+	}
+	wg.Wait()
+	log.Printf("ioload.LoadUp(): Request %d completed", ts)
+}
+
+//Tell every worker to stop. Safe to call more than once
+func (ic *IoCollection) haltWorkers() {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if ic.quit == nil { //No load request has been started yet
+		return
+	}
+	select {
+	case <-ic.quit: //Already closed
+	default:
+		close(ic.quit)
+	}
+}
+
+//Stops the current I/O load, whatever its ID
+func (ic *IoCollection) Halt() {
+	ic.haltWorkers()
+}
+
+//Stops the current I/O load if the ID requested match.  Returns a message and whether the load was stopped
+func StopLoad(iS *IoCollection, id int64) (string, bool) {
+	iS.mutex.Lock()
+	ilid := iS.ilid
+	iS.mutex.Unlock()
+	if id != ilid { //IDs don't match, go away
+		log.Printf("ioload.StopLoad(): Stop request ID (%d) does not match last load request ID (%d)", id, ilid)
+		time.Sleep(1 * time.Second)
+		return fmt.Sprintf("Incorrect stop load request ID=%d\n", id), false
+	}
+	log.Printf("ioload.StopLoad(): IDs match, stoping I/O load")
+	iS.haltWorkers()
+	return "I/O load stopped\n", true
+}
+
+//Create the work file with random data if it does not exist or has a different size
+func prepareFile(filename string, size uint64) error {
+	fi, err := os.Stat(filename)
+	if err == nil && uint64(fi.Size()) == size {
+		return nil
+	}
+	log.Printf("ioload.prepareFile(): Creating work file %s of %d bytes", filename, size)
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	chunk := make([]byte, fillChunk)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for written := uint64(0); written < size; {
+		csize := uint64(fillChunk)
+		if size-written < csize {
+			csize = size - written
+		}
+		rnd.Read(chunk[:csize])
+		_, err = f.Write(chunk[:csize])
+		if err != nil {
+			return err
+		}
+		written += csize
+	}
+	return f.Sync()
+}
+
+//Allocate a buffer whose address is aligned as required by O_DIRECT
+func alignedBuffer(size uint64) []byte {
+	buf := make([]byte, size+alignment)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) & (alignment - 1))
+	if off != 0 {
+		off = alignment - off
+	}
+	return buf[off : uint64(off)+size]
+}
+
+//Runs I/O operations on the work file until told to quit
+func ioWorker(iS *IoCollection, wid int) {
+	ip := iS.params
+	st := iS.workers[wid]
+	flags := os.O_RDWR
+	if ip.Direct {
+		flags |= syscall.O_DIRECT
+	}
+	f, err := os.OpenFile(iS.workfile, flags, 0644)
+	if err != nil {
+		log.Printf("ioload.ioWorker(): Worker %d error opening work file: %s", wid, err.Error())
+		return
+	}
+	defer f.Close()
+	buf := alignedBuffer(ip.BlockSize)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(wid)))
+	rnd.Read(buf)
+	nblocks := ip.FileSize / ip.BlockSize
+	//Sequential workers start at evenly spread positions of the file
+	block := nblocks * uint64(wid) / uint64(ip.IoDepth)
+	//Time between operations of this worker to reach the target rate
+	var interval time.Duration
+	if ip.Rate > 0 {
+		interval = time.Duration(float64(time.Second) * float64(ip.IoDepth) / float64(ip.Rate))
+	}
+	next := time.Now()
+	write := ip.Mode == SeqWrite || ip.Mode == RandWrite
+	for {
+		if interval > 0 {
+			next = next.Add(interval)
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-iS.quit:
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+		select {
+		case <-iS.quit:
+			return
+		default:
+		}
+		if ip.Mode == RandRead || ip.Mode == RandWrite {
+			block = uint64(rnd.Int63n(int64(nblocks)))
+		} else {
+			block = (block + 1) % nblocks
+		}
+		offset := int64(block * ip.BlockSize)
+		var n int
+		lt := time.Now()
+		if write {
+			n, err = f.WriteAt(buf, offset)
+			if err == nil && ip.Fsync {
+				err = f.Sync()
+			}
+		} else {
+			n, err = f.ReadAt(buf, offset)
+		}
+		if err != nil {
+			st.mutex.Lock()
+			st.errors++
+			st.mutex.Unlock()
+			log.Printf("ioload.ioWorker(): Worker %d I/O error at offset %d: %s", wid, offset, err.Error())
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		st.record(time.Since(lt), n)
+	}
+}
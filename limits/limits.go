@@ -0,0 +1,123 @@
+package limits
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+//Sources of the value of a limit
+const (
+	Env = "env" //Defined by an environment variable at start up
+	Auto = "auto" //Computed from the resources available in the system
+	Runtime = "runtime" //Overridden through the API
+)
+
+//Function that computes the automatic value of a limit, and a description of where it comes from
+type AutoFunc func() (uint64, string, error)
+
+//Limit for the total size of the resources that can be requested
+type Limit struct {
+	mutex sync.Mutex
+	name string //Name used in log messages, like HIGHMEMLIM
+	value uint64 //Effective value of the limit
+	source string //Env, Auto or Runtime
+	detail string //Where the automatic value comes from
+	envValue uint64 //Value defined by the environment variable, 0 if not defined
+	auto AutoFunc
+}
+
+//Creates a limit.  If envValue is not 0 it is used as the limit, otherwise the value is computed with the auto function
+func New(name string, envValue uint64, auto AutoFunc) (*Limit, error) {
+	lm := &Limit{name: name, envValue: envValue, auto: auto}
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	err := lm.reset()
+	if err != nil {
+		return nil, err
+	}
+	lm.logValue()
+	return lm, nil
+}
+
+//Sets the limit to the value of the environment variable, or the automatic value if there is none.  Must be called with the mutex locked
+func (lm *Limit) reset() error {
+	if lm.envValue != 0 {
+		lm.value, lm.source, lm.detail = lm.envValue, Env, lm.name+" environment variable"
+		return nil
+	}
+	value, detail, err := lm.auto()
+	if err != nil {
+		return err
+	}
+	lm.value, lm.source, lm.detail = value, Auto, detail
+	return nil
+}
+
+//Logs the current value of the limit.  Must be called with the mutex locked
+func (lm *Limit) logValue() {
+	log.Printf("%s set to: %d bytes, from %s.", lm.name, lm.value, lm.detail)
+}
+
+//Computes the limit again if its value is automatic and returns the effective value and its source.
+//If the automatic value can't be computed the previous one is kept
+func (lm *Limit) Update() (uint64, string) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	if lm.source == Auto {
+		value, detail, err := lm.auto()
+		if err != nil {
+			log.Printf("limits.Update(): Error computing %s, keeping previous value: %s", lm.name, err.Error())
+		} else {
+			lm.value, lm.detail = value, detail
+		}
+	}
+	return lm.value, lm.source
+}
+
+//Returns the effective value of the limit and its source, without computing it again
+func (lm *Limit) Get() (uint64, string) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	return lm.value, lm.source
+}
+
+//Overrides the value of the limit
+func (lm *Limit) Set(value uint64) {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	lm.value, lm.source, lm.detail = value, Runtime, "set through the API"
+	lm.logValue()
+}
+
+//Removes any runtime override, going back to the environment or automatic value
+func (lm *Limit) Reset() error {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	err := lm.reset()
+	if err != nil {
+		return err
+	}
+	lm.logValue()
+	return nil
+}
+
+//Information about a limit, as returned in JSON responses
+type Report struct {
+	Limit uint64 `json:"limit"`
+	Source string `json:"source"`
+	Detail string `json:"detail"`
+}
+
+//Returns the information about the limit, without computing it again
+func (lm *Limit) Report() Report {
+	lm.mutex.Lock()
+	defer lm.mutex.Unlock()
+	return Report{Limit: lm.value, Source: lm.source, Detail: lm.detail}
+}
+
+//Description of the limit, like "2147483648 bytes (auto: free system memory plus memory held)"
+func (lm *Limit) String() string {
+	lr := lm.Report()
+	return fmt.Sprintf("%d bytes (%s: %s)", lr.Limit, lr.Source, lr.Detail)
+}
@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//Counts HTTP requests per handler and outcome
+type RequestCounter struct {
+	mutex sync.Mutex
+	counts map[[2]string]uint64
+}
+
+//Creates an empty RequestCounter
+func NewRequestCounter() *RequestCounter {
+	return &RequestCounter{counts: make(map[[2]string]uint64)}
+}
+
+//Add one request for the handler with the outcome
+func (rc *RequestCounter) Inc(handler string, outcome string) {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.counts[[2]string{handler, outcome}]++
+}
+
+//Writes the counters in Prometheus text format with the metric name
+func (rc *RequestCounter) Write(w io.Writer, name string, help string) {
+	rc.mutex.Lock()
+	keys := make([][2]string, 0, len(rc.counts))
+	for key := range rc.counts {
+		keys = append(keys, key)
+	}
+	values := make(map[[2]string]uint64, len(rc.counts))
+	for key, value := range rc.counts {
+		values[key] = value
+	}
+	rc.mutex.Unlock()
+	//Sort the samples so the output is stable
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	Header(w, name, help, "counter")
+	for _, key := range keys {
+		Sample(w, name, float64(values[key]), "handler", key[0], "outcome", key[1])
+	}
+}
+
+//Writes the HELP and TYPE lines of a metric
+func Header(w io.Writer, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+//Writes a single sample.  labels is a list of name and value pairs
+func Sample(w io.Writer, name string, value float64, labels ...string) {
+	var lbl []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		lbl = append(lbl, fmt.Sprintf("%s=\"%s\"", labels[i], escape(labels[i+1])))
+	}
+	if len(lbl) > 0 {
+		fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(lbl, ","), value)
+	} else {
+		fmt.Fprintf(w, "%s %g\n", name, value)
+	}
+}
+
+//Writes the HELP and TYPE lines and a single sample without labels
+func Gauge(w io.Writer, name string, help string, value float64) {
+	Header(w, name, help, "gauge")
+	Sample(w, name, value)
+}
+
+//Escapes a label value as required by the text format
+func escape(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	return strings.ReplaceAll(value, `"`, `\"`)
+}
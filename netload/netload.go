@@ -0,0 +1,360 @@
+package netload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Size of the buffer of random data that is sent over and over
+const bufSize = 65536
+
+//Directions of the traffic generated by the load client
+const (
+	Upload = "upload" //Send data to the sink endpoint of the target
+	Download = "download" //Receive data from the source endpoint of the target
+)
+
+//Parameters of a network load request
+type NetParams struct {
+	Target string //Base URL of another testero instance, like http://testero:8080
+	Direction string //Upload or Download
+	Rate uint64 //Target bits per second for all the streams together, 0 means unlimited
+	Duration uint64 //Load time in seconds
+	Streams int //Number of concurrent connections
+	Token string //Bearer token sent to the target, empty to send none
+}
+
+//Check the parameters are consistent
+func (np NetParams) Validate() error {
+	if !strings.HasPrefix(np.Target, "http://") && !strings.HasPrefix(np.Target, "https://") {
+		return fmt.Errorf("Invalid target, must be an http or https URL: %s", np.Target)
+	}
+	if np.Direction != Upload && np.Direction != Download {
+		return fmt.Errorf("Invalid direction: %s, valid directions are: upload, download", np.Direction)
+	}
+	if np.Streams <= 0 {
+		return fmt.Errorf("Number of streams must be greater than 0: streams=%d", np.Streams)
+	}
+	//Every stream gets its share of the rate and paces it in bytes, a share under 8 bits per second would be 0, meaning no limit
+	if np.Rate > 0 && np.Rate < 8*uint64(np.Streams) {
+		return fmt.Errorf("Rate must be at least 8 bits per second per stream: rate=%d bits per second, streams=%d", np.Rate, np.Streams)
+	}
+	return nil
+}
+
+//Contains information about the network load task and the data served to other instances
+type NetCollection struct {
+	nlid int64 //Request ID corresponds to the Unix time when the request was sent
+	params NetParams //Parameters of the latest request
+	start time.Time //When the load started
+	end time.Time //When the load ended, zero while running
+	sent uint64 //Bytes sent by the load client, accessed atomically
+	received uint64 //Bytes received by the load client, accessed atomically
+	errors uint64 //Failed connections of the load client, accessed atomically
+	sinkBytes uint64 //Bytes discarded by the sink endpoint, accessed atomically
+	sourceBytes uint64 //Bytes generated by the source endpoint, accessed atomically
+	cancel context.CancelFunc //Stops the streams of the current request
+	mutex *sync.Mutex //Protects the request fields while they are replaced
+}
+
+//Initialize a NetCollection object
+func (nc *NetCollection) NewNc() {
+	nc.nlid = 0
+	nc.mutex = &sync.Mutex{}
+}
+
+//Reader that generates data at a limited rate until its context is done
+type pacedReader struct {
+	ctx context.Context
+	data []byte
+	rate uint64 //Bytes per second, 0 means unlimited
+	start time.Time
+	total uint64 //Bytes read so far
+	limit uint64 //Maximum bytes to read, 0 means no limit
+	counter *uint64 //Updated atomically with every read
+}
+
+//Creates a reader of random data.  rate is in bits per second
+func newPacedReader(ctx context.Context, rate uint64, limit uint64, counter *uint64) *pacedReader {
+	data := make([]byte, bufSize)
+	rand.New(rand.NewSource(time.Now().UnixNano())).Read(data)
+	return &pacedReader{ctx: ctx, data: data, rate: rate / 8, start: time.Now(), limit: limit, counter: counter}
+}
+
+//Fills p with data, waiting if needed to keep the rate
+func (pr *pacedReader) Read(p []byte) (int, error) {
+	select {
+	case <-pr.ctx.Done():
+		return 0, io.EOF
+	default:
+	}
+	if pr.limit > 0 && pr.total >= pr.limit {
+		return 0, io.EOF
+	}
+	if pr.rate > 0 {
+		//Time when the bytes already read should have been read at the target rate
+		due := pr.start.Add(time.Duration(float64(pr.total) / float64(pr.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			select {
+			case <-pr.ctx.Done():
+				return 0, io.EOF
+			case <-time.After(wait):
+			}
+		}
+	}
+	n := copy(p, pr.data)
+	if pr.limit > 0 && uint64(n) > pr.limit-pr.total {
+		n = int(pr.limit - pr.total)
+	}
+	pr.total += uint64(n)
+	atomic.AddUint64(pr.counter, uint64(n))
+	return n, nil
+}
+
+//Discards the body of the request and returns the number of bytes received and the time it took
+func Sink(nS *NetCollection, request *http.Request) (uint64, time.Duration, error) {
+	lt := time.Now()
+	counter := &countWriter{counter: &nS.sinkBytes}
+	n, err := io.Copy(counter, request.Body)
+	if err != nil {
+		log.Printf("netload.Sink(): Error receiving data from %s after %d bytes: %s", request.RemoteAddr, n, err.Error())
+		return uint64(n), time.Since(lt), fmt.Errorf("Error receiving data after %d bytes: %s", n, err.Error())
+	}
+	return uint64(n), time.Since(lt), nil
+}
+
+//Writer that discards the data and counts the bytes atomically
+type countWriter struct {
+	counter *uint64
+}
+
+//Discards p
+func (cw *countWriter) Write(p []byte) (int, error) {
+	atomic.AddUint64(cw.counter, uint64(len(p)))
+	return len(p), nil
+}
+
+//Streams generated data to the writer at rate bits per second, for duration seconds or until size bytes are sent.
+//A duration or size of 0 means no limit on that value, the stream also ends when the client goes away
+func Source(nS *NetCollection, writer http.ResponseWriter, request *http.Request, rate uint64, duration uint64, size uint64) {
+	ctx := request.Context()
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(duration)*time.Second)
+		defer cancel()
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	pr := newPacedReader(ctx, rate, size, &nS.sourceBytes)
+	buf := make([]byte, bufSize)
+	flusher, canFlush := writer.(http.Flusher)
+	for {
+		n, err := pr.Read(buf)
+		if err != nil {
+			return
+		}
+		_, err = writer.Write(buf[:n])
+		if err != nil {
+			log.Printf("netload.Source(): Error sending data to %s: %s", request.RemoteAddr, err.Error())
+			return
+		}
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+}
+
+//Runs the network load streams against the target during the requested time
+func LoadUp(nS *NetCollection, ts int64, np NetParams, lock chan int64) {
+	select {
+	case <-time.After(5 * time.Second): //If 5 seconds pass without getting the proper lock, abort
+		log.Printf("netload.LoadUp(): timeout waiting for lock")
+		return
+	case chts := <-lock:
+		if chts == ts { //Got the lock and if it matches the timestamp received, proceed
+			defer func() {
+				lock <- 0 //Release lock
+			}()
+			log.Printf("netload.LoadUp(): lock obtained, timestamps match: %d\n", ts)
+		} else {
+			log.Printf("netload.LoadUp(): lock obtained, but timestamps missmatch: %d - %d\n", ts, chts)
+			lock <- chts
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(np.Duration)*time.Second)
+	defer cancel()
+	nS.mutex.Lock()
+	nS.nlid = ts
+	nS.params = np
+	nS.start = time.Now()
+	nS.end = time.Time{}
+	nS.cancel = cancel
+	atomic.StoreUint64(&nS.sent, 0)
+	atomic.StoreUint64(&nS.received, 0)
+	atomic.StoreUint64(&nS.errors, 0)
+	nS.mutex.Unlock()
+	log.Printf("Network %s load to %s for %d seconds with %d streams", np.Direction, np.Target, np.Duration, np.Streams)
+	var wg sync.WaitGroup
+	for i := 0; i < np.Streams; i++ {
+		wg.Add(1)
+		go func(sid int) {
+			defer wg.Done()
+			stream(ctx, nS, np, sid)
+		}(i)
+	}
+	wg.Wait()
+	nS.mutex.Lock()
+	nS.end = time.Now()
+	nS.mutex.Unlock()
+	log.Printf("netload.LoadUp(): Request %d completed, sent %d bytes, received %d bytes", ts, atomic.LoadUint64(&nS.sent), atomic.LoadUint64(&nS.received))
+}
+
+//Keeps a single connection to the target busy until the context is done.  The connection is opened again if it fails
+func stream(ctx context.Context, nS *NetCollection, np NetParams, sid int) {
+	rate := np.Rate / uint64(np.Streams) //Every stream gets its share of the rate
+	target := strings.TrimRight(np.Target, "/")
+	for ctx.Err() == nil {
+		var request *http.Request
+		var err error
+		if np.Direction == Upload {
+			//The body ends when the context is done, so the request is not bound to the context and the upload finishes cleanly
+			body := newPacedReader(ctx, rate, 0, &nS.sent)
+			request, err = http.NewRequest("POST", target+"/api/net/sink", body)
+		} else {
+			url := fmt.Sprintf("%s/api/net/source?rate=%g", target, float64(rate)/1000000)
+			request, err = http.NewRequestWithContext(ctx, "GET", url, nil)
+		}
+		if err != nil {
+			log.Printf("netload.stream(): Stream %d error creating request: %s", sid, err.Error())
+			return
+		}
+		if np.Token != "" {
+			request.Header.Set("Authorization", "Bearer "+np.Token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err == nil && response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			err = fmt.Errorf("target returned %s", response.Status)
+		} else if err == nil {
+			if np.Direction == Download {
+				_, err = io.Copy(&countWriter{counter: &nS.received}, response.Body)
+			} else {
+				_, err = io.Copy(ioutil.Discard, response.Body)
+			}
+			response.Body.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			atomic.AddUint64(&nS.errors, 1)
+			log.Printf("netload.stream(): Stream %d connection error: %s", sid, err.Error())
+			select {
+			case <-ctx.Done():
+			case <-time.After(1 * time.Second):
+			}
+		}
+	}
+}
+
+//Stops the current network load if the ID requested match.  Returns a message and whether the load was stopped
+func StopLoad(nS *NetCollection, id int64) (string, bool) {
+	nS.mutex.Lock()
+	nlid := nS.nlid
+	cancel := nS.cancel
+	nS.mutex.Unlock()
+	if id != nlid || cancel == nil { //IDs don't match, go away
+		log.Printf("netload.StopLoad(): Stop request ID (%d) does not match last load request ID (%d)", id, nlid)
+		time.Sleep(1 * time.Second)
+		return fmt.Sprintf("Incorrect stop load request ID=%d\n", id), false
+	}
+	log.Printf("netload.StopLoad(): IDs match, stoping network load")
+	cancel()
+	return "Network load stopped\n", true
+}
+
+//Stops the current network load, whatever its ID
+func (nc *NetCollection) Halt() {
+	nc.mutex.Lock()
+	cancel := nc.cancel
+	nc.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
+
+//Information about the current or last load request and the data served to other instances, used in reports
+type Report struct {
+	RequestID int64 `json:"request_id"` //0 if no request has been processed yet
+	State string `json:"state,omitempty"`
+	Target string `json:"target,omitempty"`
+	Direction string `json:"direction,omitempty"`
+	Streams int `json:"streams,omitempty"`
+	Rate uint64 `json:"rate"` //Target bits per second, 0 means unlimited
+	Time uint64 `json:"time"` //Load time requested in seconds
+	Elapsed float64 `json:"elapsed_seconds"`
+	Sent uint64 `json:"bytes_sent"`
+	Received uint64 `json:"bytes_received"`
+	Errors uint64 `json:"connection_errors"`
+	Mbps float64 `json:"mbit_per_second"`
+	SinkBytes uint64 `json:"sink_bytes"`
+	SourceBytes uint64 `json:"source_bytes"`
+}
+
+//Get information about the current or last load request and the data served to other instances
+func (nc *NetCollection) GetActLoad() Report {
+	nc.mutex.Lock()
+	id := nc.nlid
+	np := nc.params
+	start := nc.start
+	end := nc.end
+	nc.mutex.Unlock()
+	rep := Report{RequestID: id, SinkBytes: atomic.LoadUint64(&nc.sinkBytes), SourceBytes: atomic.LoadUint64(&nc.sourceBytes)}
+	if id == 0 {
+		return rep
+	}
+	rep.State = "running"
+	if !end.IsZero() {
+		rep.State = "completed"
+	} else {
+		end = time.Now()
+	}
+	rep.Target, rep.Direction, rep.Streams, rep.Rate, rep.Time = np.Target, np.Direction, np.Streams, np.Rate, np.Duration
+	rep.Elapsed = end.Sub(start).Seconds()
+	rep.Sent = atomic.LoadUint64(&nc.sent)
+	rep.Received = atomic.LoadUint64(&nc.received)
+	rep.Errors = atomic.LoadUint64(&nc.errors)
+	if rep.Elapsed > 0 {
+		rep.Mbps = float64(rep.Sent+rep.Received) * 8 / 1000000 / rep.Elapsed
+	}
+	return rep
+}
+
+//Generate a message with the information of the report
+func (rep Report) String() string {
+	var mensj string
+	if rep.RequestID == 0 {
+		mensj = "No network load request has been processed yet\n"
+	} else {
+		mensj = fmt.Sprintf("Last request ID: %d\nState: %s\n", rep.RequestID, rep.State)
+		mensj += fmt.Sprintf("Target: %s, direction: %s, streams: %d\n", rep.Target, rep.Direction, rep.Streams)
+		if rep.Rate > 0 {
+			mensj += fmt.Sprintf("Target rate: %d bits/s\n", rep.Rate)
+		} else {
+			mensj += "Target rate: unlimited\n"
+		}
+		mensj += fmt.Sprintf("Load time requested: %d seconds, elapsed: %d seconds\n", rep.Time, int64(rep.Elapsed))
+		mensj += fmt.Sprintf("Bytes sent: %d, bytes received: %d, connection errors: %d\n", rep.Sent, rep.Received, rep.Errors)
+		if rep.Elapsed > 0 {
+			mensj += fmt.Sprintf("Achieved: %.2f Mbit/s\n", rep.Mbps)
+		}
+	}
+	mensj += fmt.Sprintf("Sink bytes received: %d, source bytes sent: %d\n", rep.SinkBytes, rep.SourceBytes)
+	return mensj
+}
@@ -0,0 +1,27 @@
+package netload
+
+import (
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		np NetParams
+		fail bool
+	}{
+		{NetParams{Target: "http://testero-b:8080", Direction: Upload, Streams: 1}, false},
+		{NetParams{Target: "https://testero-b", Direction: Download, Rate: 80000000, Streams: 4}, false},
+		{NetParams{Target: "http://testero-b", Direction: Upload, Rate: 32, Streams: 4}, false},
+		{NetParams{Target: "http://testero-b", Direction: Upload, Rate: 31, Streams: 4}, true},
+		{NetParams{Target: "http://testero-b", Direction: Upload, Rate: 4, Streams: 4}, true},
+		{NetParams{Target: "http://testero-b", Direction: Download, Rate: 7, Streams: 1}, true},
+		{NetParams{Target: "testero-b:8080", Direction: Upload, Streams: 1}, true},
+		{NetParams{Target: "http://testero-b", Direction: "sideways", Streams: 1}, true},
+		{NetParams{Target: "http://testero-b", Direction: Upload, Streams: 0}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.np.Validate(); (err != nil) != tt.fail {
+			t.Errorf("Validate(%+v) = %v, want fail %t", tt.np, err, tt.fail)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package partdisk
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/tale-toul/testero/ioload"
+)
+
+//Name of the marker file written in the base dir of every tree, identifies the trees created by testero
+const markerName = ".testero"
+
+//Base dirs of the trees created by versions without marker: random lower case letters
+var legacyName = regexp.MustCompile(fmt.Sprintf("^[a-z]{%d}$", rstl))
+//Subdirectories of a tree, one for every file size
+var sizeDir = regexp.MustCompile("^d-[0-9]+$")
+//Files created in the subdirectories
+var treeFile = regexp.MustCompile("^f-[0-9]+$")
+
+//Contents of the marker file, describes the instance that created the tree
+type Marker struct {
+	Host string `json:"host"`
+	PID int `json:"pid"`
+	Started time.Time `json:"started"`
+}
+
+//A tree left by a previous run of the application
+type Orphan struct {
+	Path string `json:"path"`
+	//Instance that created the tree, nil if it was created by a version without marker
+	Marker *Marker `json:"marker,omitempty"`
+	//Bytes used by the files that are removed with the tree
+	Size uint64 `json:"size"`
+	//Last modification of the tree
+	Modified time.Time `json:"modified"`
+}
+
+//Writes the marker in the base dir of the tree and keeps it locked while the application runs, so other instances
+//sharing the same directory don't take the tree for an orphan
+func (fc *FileCollection) WriteMarker() error {
+	host, _ := os.Hostname()
+	data, err := json.Marshal(Marker{Host: host, PID: os.Getpid(), Started: time.Now()})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(fc.GetRandStr(), markerName), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if fc.marker != nil {
+		fc.marker.Close()
+	}
+	fc.marker = f
+	return nil
+}
+
+//Changes the base dir of the tree
+func (fc *FileCollection) setRandStr(path string) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	fc.frandi = path
+}
+
+//Finds the trees in basedir left by previous runs, newest first.  The current tree and the trees whose marker
+//is locked by a running instance are not included
+func (fc *FileCollection) FindOrphans(basedir string) ([]Orphan, error) {
+	entries, err := ioutil.ReadDir(basedir)
+	if err != nil {
+		return nil, err
+	}
+	var orphans []Orphan
+	for _, entry := range entries {
+		path := filepath.Join(basedir, entry.Name())
+		if !entry.IsDir() || filepath.Clean(path) == filepath.Clean(fc.GetRandStr()) {
+			continue
+		}
+		orphan, ok := checkTree(path)
+		if !ok {
+			continue
+		}
+		orphan.Modified = entry.ModTime()
+		orphans = append(orphans, orphan)
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		return orphans[i].Modified.After(orphans[j].Modified)
+	})
+	return orphans, nil
+}
+
+//Checks if the directory is a tree created by testero that no running instance owns.  Returns its description and true if it is.
+//A directory without marker is only accepted if it has the exact layout of a tree: at least one d-<size> subdirectory,
+//with nothing but f-<number> files in them, and the I/O work file
+func checkTree(path string) (Orphan, bool) {
+	orphan := Orphan{Path: path}
+	f, err := os.Open(filepath.Join(path, markerName))
+	if err == nil {
+		defer f.Close()
+		if syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil {
+			log.Printf("checkTree(): Tree %s is in use by another instance", path)
+			return orphan, false
+		}
+		defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		var marker Marker
+		if data, errr := ioutil.ReadAll(f); errr == nil && json.Unmarshal(data, &marker) == nil {
+			orphan.Marker = &marker
+		} else {
+			orphan.Marker = &Marker{}
+		}
+		if fi, errs := f.Stat(); errs == nil {
+			orphan.Size += uint64(fi.Size())
+		}
+	} else if !legacyName.MatchString(filepath.Base(path)) {
+		return orphan, false
+	}
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		return orphan, false
+	}
+	subdirs := 0
+	for _, entry := range entries {
+		switch {
+		case entry.Name() == markerName:
+		case entry.Name() == ioload.WorkFileName && entry.Mode().IsRegular():
+			orphan.Size += uint64(entry.Size())
+		case sizeDir.MatchString(entry.Name()) && entry.IsDir():
+			files, only := treeFiles(filepath.Join(path, entry.Name()))
+			if !only && orphan.Marker == nil {
+				return orphan, false
+			}
+			for _, file := range files {
+				orphan.Size += uint64(file.Size())
+			}
+			subdirs++
+		default:
+			//Without marker only the exact layout of a tree is accepted, with marker other entries are left in place
+			if orphan.Marker == nil {
+				return orphan, false
+			}
+		}
+	}
+	if orphan.Marker == nil && subdirs == 0 {
+		return orphan, false
+	}
+	return orphan, true
+}
+
+//Lists the f-<number> files in a subdirectory of a tree.  The second value is false if the subdirectory contains anything else
+func treeFiles(directory string) ([]os.FileInfo, bool) {
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, false
+	}
+	only := true
+	var files []os.FileInfo
+	for _, entry := range entries {
+		if entry.Mode().IsRegular() && treeFile.MatchString(entry.Name()) {
+			files = append(files, entry)
+		} else {
+			only = false
+		}
+	}
+	return files, only
+}
+
+//Removes the entries created by testero in an orphan tree: the f-<number> files of the d-<size> subdirectories, the I/O
+//work file and the marker.  The subdirectories and the tree itself are removed only if nothing else is left in them
+func RemoveOrphan(orphan Orphan) error {
+	entries, err := ioutil.ReadDir(orphan.Path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := filepath.Join(orphan.Path, entry.Name())
+		switch {
+		case sizeDir.MatchString(entry.Name()) && entry.IsDir():
+			files, _ := treeFiles(name)
+			for _, file := range files {
+				if err = os.Remove(filepath.Join(name, file.Name())); err != nil {
+					return err
+				}
+			}
+			if os.Remove(name) != nil {
+				log.Printf("RemoveOrphan(): Keeping %s, it contains other files", name)
+			}
+		case entry.Name() == ioload.WorkFileName && entry.Mode().IsRegular(), entry.Name() == markerName:
+			if err = os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	if os.Remove(orphan.Path) != nil {
+		log.Printf("RemoveOrphan(): Keeping %s, it contains other files", orphan.Path)
+	}
+	return nil
+}
+
+//Takes over the files of an orphan tree, that replaces the current tree.  The current tree must not contain files.
+//Files that don't have the size of their directory, left by a request interrupted while writing, are removed.
+//Returns the number of files and the bytes they use
+func (fc *FileCollection) Adopt(orphan Orphan) (uint64, uint64, error) {
+	for _, fsize := range fc.fileSizes {
+		directory := fmt.Sprintf("%s/d-%d", orphan.Path, fsize)
+		if err := os.MkdirAll(directory, 0755); err != nil {
+			return 0, 0, err
+		}
+		files, _ := treeFiles(directory)
+		for _, file := range files {
+			if uint64(file.Size()) != fsize {
+				log.Printf("Adopt(): Removing incomplete file %s/%s", directory, file.Name())
+				if err := os.Remove(filepath.Join(directory, file.Name())); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+	}
+	previous := fc.GetRandStr()
+	fc.setRandStr(orphan.Path)
+	err := fc.WriteMarker()
+	if err != nil {
+		fc.setRandStr(previous)
+		return 0, 0, err
+	}
+	os.RemoveAll(previous)
+	return fc.recount()
+}
@@ -0,0 +1,87 @@
+package partdisk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tale-toul/testero/ioload"
+)
+
+//Creates the files with the sizes specified, and their directories
+func writeFiles(t *testing.T, base string, files map[string]int) {
+	for name, size := range files {
+		path := filepath.Join(base, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCheckTree(t *testing.T) {
+	base, err := ioutil.TempDir("", "orphans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	writeFiles(t, base, map[string]int{
+		"marked/" + markerName: 10, "marked/d-512/f-1": 512, "marked/" + ioload.WorkFileName: 100, "marked/notes": 7,
+		"abcdefg/d-512/f-1": 512, "abcdefg/d-512/f-2": 512,
+		"hijklmn/d-512/f-1": 512, "hijklmn/d-512/important": 1,
+		"opqrstu/" + ioload.WorkFileName: 100,
+		"old-data/d-1/f-1": 1,
+		"vwxyzab/d-512/f-1": 512, "vwxyzab/photo.jpg": 1,
+	})
+	tests := []struct {
+		name string
+		found, marked bool
+		size uint64
+	}{
+		{"marked", true, true, 622}, //Other files are left in place and not counted
+		{"abcdefg", true, false, 1024},
+		{"hijklmn", false, false, 0}, //Unknown file in a size directory
+		{"opqrstu", false, false, 0}, //No size directory
+		{"old-data", false, false, 0}, //Not a random name
+		{"vwxyzab", false, false, 0}, //Unknown file in the base dir
+	}
+	for _, tt := range tests {
+		orphan, found := checkTree(filepath.Join(base, tt.name))
+		if found != tt.found || (found && (orphan.Marker != nil) != tt.marked) || (found && orphan.Size != tt.size) {
+			t.Errorf("checkTree(%s) = found %t, marker %v, size %d, want found %t, marked %t, size %d", tt.name, found, orphan.Marker, orphan.Size, tt.found, tt.marked, tt.size)
+		}
+	}
+}
+
+func TestRemoveOrphan(t *testing.T) {
+	base, err := ioutil.TempDir("", "orphans")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	writeFiles(t, base, map[string]int{
+		"marked/" + markerName: 10, "marked/d-512/f-1": 512, "marked/d-1024/f-1": 1024, "marked/d-1024/keep": 1,
+		"marked/" + ioload.WorkFileName: 100, "marked/notes": 7,
+		"abcdefg/d-512/f-1": 512,
+	})
+	for _, name := range []string{"marked", "abcdefg"} {
+		if err := RemoveOrphan(Orphan{Path: filepath.Join(base, name)}); err != nil {
+			t.Fatalf("RemoveOrphan(%s): %v", name, err)
+		}
+	}
+	gone := []string{"marked/" + markerName, "marked/d-512", "marked/d-1024/f-1", "marked/" + ioload.WorkFileName, "abcdefg"}
+	kept := []string{"marked/notes", "marked/d-1024/keep"}
+	for _, name := range gone {
+		if _, err := os.Stat(filepath.Join(base, name)); !os.IsNotExist(err) {
+			t.Errorf("%s was not removed", name)
+		}
+	}
+	for _, name := range kept {
+		if _, err := os.Stat(filepath.Join(base, name)); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+}
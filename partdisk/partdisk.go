@@ -1,6 +1,8 @@
 package partdisk
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -10,13 +12,75 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+
+	"github.com/tale-toul/testero/ioload"
 )
 
 //Max number of files for each size that can be created
 const limitFiles uint64 = 25
 //Length of random id string
 const rstl int = 7
+//Size of the blocks written to files
+const wblock uint64 = 65536
+
+//Ways to generate the data written to files
+const (
+	ContentRandom = "random" //Pseudo random bytes, unique for every block
+	ContentZero = "zero" //All bytes set to zero
+	ContentAscii = "ascii" //Printable ASCII characters picked from a small table
+)
+
+//Ways to create files
+const (
+	ModeWrite = "write" //Every byte is written to the file
+	ModeFallocate = "fallocate" //Space is reserved instantly with fallocate(), without writing data
+	ModeSparse = "sparse" //The file gets its size but no blocks are allocated
+)
+
+//Check that the file creation mode is one of the supported values
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeWrite, ModeFallocate, ModeSparse:
+		return true
+	}
+	return false
+}
+
+//Defines the data written to new files
+type FileContent struct {
+	//One of the Content constants
+	kind string
+	//Target compression ratio for random content, 1 means incompressible
+	ratio uint64
+}
+
+//Creates a FileContent after checking the kind and ratio are valid.
+//ratio is only used with random content, a value of 0 means incompressible
+func NewContent(kind string, ratio uint64) (FileContent, error) {
+	switch kind {
+	case ContentRandom, ContentZero, ContentAscii:
+	default:
+		return FileContent{}, fmt.Errorf("Invalid content type: %s, valid types are: random, zero, ascii", kind)
+	}
+	if ratio == 0 {
+		ratio = 1
+	}
+	if ratio > 1 && kind != ContentRandom {
+		return FileContent{}, fmt.Errorf("A compression ratio can only be used with random content")
+	}
+	return FileContent{kind: kind, ratio: ratio}, nil
+}
+
+//Describes the content type
+func (fct FileContent) String() string {
+	if fct.kind == ContentRandom && fct.ratio > 1 {
+		return fmt.Sprintf("%s, compression ratio %d", fct.kind, fct.ratio)
+	}
+	return fct.kind
+}
 
 //Holds a representation of the file data
 type FileCollection struct {
@@ -26,26 +90,54 @@ type FileCollection struct {
 	fileAmmount []uint64
 	//Last request ID
 	flid int64
+	//Content of the files created by the last request
+	content FileContent
+	//Creation mode of the last request
+	mode string
 	//Base dir made of random id string
 	frandi string
+	//Marker file of the tree, locked while the application runs
+	marker *os.File
+	//Protects fileSizes, flid, content, mode and frandi, that are read without the lock channel.  Shared by all copies of the collection
+	mutex *sync.Mutex
 }
 
 //Get FileCollection random string
-func (fc FileCollection) GetRandStr() string {
+func (fc *FileCollection) GetRandStr() string {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
 	return fc.frandi
 }
 
+//Get FileCollection last request ID
+func (fc *FileCollection) GetID() int64 {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.flid
+}
+
 //Get FileCollection fileSizes
-func (fc FileCollection) GetFileSizes() []uint64 {
+func (fc *FileCollection) GetFileSizes() []uint64 {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
 	return fc.fileSizes
 }
 
 //Initializes a FileCollection struct
 func (fc *FileCollection) NewfC(basedir string) {
+	if fc.mutex == nil {
+		fc.mutex = &sync.Mutex{}
+	}
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
 	//                      512Kb   2Mb      8Mb      32Mb      128Mb
 	fc.fileSizes = []uint64{524288, 2097152, 8388608, 33554432, 134217728}
 	fc.fileAmmount = make([]uint64, len(fc.fileSizes))
 	fc.frandi = basedir+"/"+randstring(rstl)
+	if fc.marker != nil {
+		fc.marker.Close()
+		fc.marker = nil
+	}
 }
 
 //Creates a random string made of lower case letters only
@@ -83,10 +175,11 @@ func randbytes(size uint64) []byte {
 }
 
 //Get the total number of bytes used up by the files already created
-func (fc FileCollection) totalFileSize() (uint64,error)	{
+func (fc *FileCollection) TotalFileSize() (uint64,error)	{
 	var tfsize uint64
-	for _,fsize := range fc.fileSizes {
-		directory := fmt.Sprintf("%s/d-%d",fc.frandi,fsize)
+	base := fc.GetRandStr()
+	for _,fsize := range fc.GetFileSizes() {
+		directory := fmt.Sprintf("%s/d-%d",base,fsize)
 		fileList,err := getFilesInDir(directory)
 		if err != nil {
 			log.Printf("totalSizeFiles(): Error listing directory: %s\n%s",directory,err.Error())
@@ -99,18 +192,47 @@ func (fc FileCollection) totalFileSize() (uint64,error)	{
 	return tfsize,nil
 }
 
+//Get the size and the disk space allocated of the I/O work file in the tree, 0 if it does not exist
+func (fc *FileCollection) IoFileSize() (uint64,uint64) {
+	fi,err := os.Stat(fc.GetRandStr()+"/"+ioload.WorkFileName)
+	if err != nil {
+		return 0,0
+	}
+	return uint64(fi.Size()),uint64(allocatedSize(fi))
+}
+
+//Sets the number of files of each size to the files present in the directories.
+//Returns the number of files and the bytes they use
+func (fc *FileCollection) recount() (uint64,uint64,error) {
+	var nfiles,tfsize uint64
+	base := fc.GetRandStr()
+	for index,fsize := range fc.fileSizes {
+		directory := fmt.Sprintf("%s/d-%d",base,fsize)
+		fileList,err := getFilesInDir(directory)
+		if err != nil {
+			return 0,0,err
+		}
+		fc.fileAmmount[index] = uint64(len(fileList))
+		nfiles += uint64(len(fileList))
+		for _,v := range fileList {
+			tfsize += uint64(v.Size())
+		}
+	}
+	return nfiles,tfsize,nil
+}
+
 //Compute the number of files of each size required for the size requested
 //tsize contains the number of bytes to allocate
 //hlimit is the maximum size that can be requested
 func DefineFiles(tsize uint64, hilimit uint64, flS *FileCollection) error {
 	var nfiles, remain uint64
-	tfs, err := flS.totalFileSize() 
+	tfs, err := flS.TotalFileSize() 
 	if err != nil {
 		log.Printf("DefineFiles(): Error computing total file size: %s", err.Error())
 		return err
 	}
 	if tsize > tfs && tsize > hilimit { //Trying to add files and the total size exceeds the limit
-		return fmt.Errorf("Size requested is over the limit: requested %d bytes, limit: %d bytes.", tsize, hilimit)
+		return &LimitError{Requested: tsize, Limit: hilimit}
 	}
 	for index, fsize := range flS.fileSizes {
 		nfiles = tsize / fsize
@@ -145,41 +267,110 @@ func DefineFiles(tsize uint64, hilimit uint64, flS *FileCollection) error {
 	return nil
 }
 
+//Number and size of the files of a single size, used in reports
+type FileCount struct {
+	Size uint64 `json:"size"`
+	Count uint64 `json:"count"`
+	TotalSize uint64 `json:"total_size"`
+	Allocated uint64 `json:"allocated,omitempty"`
+}
+
+//Report about the files, either defined or actually created
+type FilesReport struct {
+	RequestID int64 `json:"request_id"`
+	Content string `json:"content,omitempty"`
+	Mode string `json:"mode,omitempty"`
+	Files []FileCount `json:"files"`
+	TotalSize uint64 `json:"total_size"`
+	TotalAllocated uint64 `json:"total_allocated,omitempty"`
+}
+
+//Error returned when the size requested is over the limit
+type LimitError struct {
+	Requested uint64
+	Limit uint64
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("Size requested is over the limit: requested %d bytes, limit: %d bytes.", le.Requested, le.Limit)
+}
+
+//Computes the number of _file_ elements defined
+func DefFiles(fS *FileCollection) FilesReport {
+	rep := FilesReport{RequestID: fS.GetID()}
+	for index, value := range fS.fileSizes {
+		rep.Files = append(rep.Files, FileCount{Size: value, Count: fS.fileAmmount[index], TotalSize: value*fS.fileAmmount[index]})
+		rep.TotalSize += value * fS.fileAmmount[index]
+	}
+	return rep
+}
+
 //Prints the number of _file_ elements defined
 func GetDefFiles(fS *FileCollection) string {
-	var semiTotal uint64
 	var rst string
-	for index, value := range fS.fileSizes {
-		semiTotal += value * fS.fileAmmount[index]
-		rst += fmt.Sprintf("Files of size: %d, count: %d, total size: %d\n", value, fS.fileAmmount[index], value*fS.fileAmmount[index])
+	rep := DefFiles(fS)
+	for _, fcount := range rep.Files {
+		rst += fmt.Sprintf("Files of size: %d, count: %d, total size: %d\n", fcount.Size, fcount.Count, fcount.TotalSize)
 	}
-	rst += fmt.Sprintf("Total size reserved: %d bytes.\n", semiTotal)
+	rst += fmt.Sprintf("Total size reserved: %d bytes.\n", rep.TotalSize)
 	return rst
 }
 
-//Generate a message with information about the actual ammount and size of the existing files
-func (fc FileCollection) GetActFiles() string {
-	var mensj string
-	var totalSize int64
-	mensj += fmt.Sprintf("Last request ID: %d\n",fc.flid)
-	for _,fsize := range fc.fileSizes {
-		directory := fmt.Sprintf("%s/d-%d",fc.frandi,fsize)
+//Computes the actual ammount and size of the existing files.  Safe to call while the files are being created
+func (fc *FileCollection) ActFiles() (FilesReport, error) {
+	fc.mutex.Lock()
+	rep := FilesReport{RequestID: fc.flid, Content: fc.content.String(), Mode: fc.mode}
+	base, sizes := fc.frandi, fc.fileSizes
+	fc.mutex.Unlock()
+	for _,fsize := range sizes {
+		directory := fmt.Sprintf("%s/d-%d",base,fsize)
 		fileList,err := getFilesInDir(directory)
 		if err != nil {
-			log.Printf("GetActFiles(): Error listing directory: %s\n%s",directory,err.Error())
-			return "Error getting files information\n"
+			log.Printf("ActFiles(): Error listing directory: %s\n%s",directory,err.Error())
+			return rep, err
 		} 
-		mensj += fmt.Sprintf("Files of size: %d, Count: %d\n", fsize,len(fileList))
+		fcount := FileCount{Size: fsize, Count: uint64(len(fileList))}
 		for _,fl := range fileList{
-			totalSize += fl.Size()
+			fcount.TotalSize += uint64(fl.Size())
+			fcount.Allocated += uint64(allocatedSize(fl))
 		}
+		rep.Files = append(rep.Files, fcount)
+		rep.TotalSize += fcount.TotalSize
+		rep.TotalAllocated += fcount.Allocated
+	}
+	return rep, nil
+}
+
+//Generate a message with information about the actual ammount and size of the existing files
+func (fc *FileCollection) GetActFiles() string {
+	rep, err := fc.ActFiles()
+	if err != nil {
+		return "Error getting files information\n"
 	}
-	mensj += fmt.Sprintf("Total size: %d bytes.\n",totalSize)
+	mensj := fmt.Sprintf("Last request ID: %d\n",rep.RequestID)
+	mensj += fmt.Sprintf("Last request content: %s, mode: %s\n",rep.Content,rep.Mode)
+	for _,fcount := range rep.Files {
+		mensj += fmt.Sprintf("Files of size: %d, Count: %d, Allocated: %d bytes\n", fcount.Size,fcount.Count,fcount.Allocated)
+	}
+	mensj += fmt.Sprintf("Total size: %d bytes.\n",rep.TotalSize)
+	mensj += fmt.Sprintf("Total allocated: %d bytes.\n",rep.TotalAllocated)
 	return mensj
 }
 
+//Get the disk space actually allocated to a file, from the number of 512 byte blocks reported by stat
+func allocatedSize(fi os.FileInfo) int64 {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fi.Size()
+	}
+	return st.Blocks * 512
+}
+
 //Create or remove files to reach the requested number of files of each size
-func CreateFiles(fS *FileCollection, ts int64, filelock chan int64) {
+//content defines the data written to the new files and mode how they are created.  If ctx is cancelled the file being
+//written is removed, the files already created are kept and the definition is updated to match them.
+//Returns an error if the files could not be created
+func CreateFiles(ctx context.Context, fS *FileCollection, ts int64, content FileContent, mode string, filelock chan int64) error {
 	var lt time.Time
 	var err error
 
@@ -187,11 +378,15 @@ func CreateFiles(fS *FileCollection, ts int64, filelock chan int64) {
 	case <- time.After(5 * time.Second):
 		//If 5 seconds pass without getting the proper lock, abort
 		log.Printf("partdisk.CreateFiles(): timeout waiting for lock\n")
-		return
+		return fmt.Errorf("timeout waiting for lock")
 	case chts := <- filelock:
 		if chts == ts { //Got the lock and it matches the timestamp received
 			//Proceed
+			fS.mutex.Lock()
 			fS.flid = ts
+			fS.content = content
+			fS.mode = mode
+			fS.mutex.Unlock()
 			defer func(){
 				filelock <- 0 //Release lock
 			}()
@@ -200,22 +395,36 @@ func CreateFiles(fS *FileCollection, ts int64, filelock chan int64) {
 		} else {
 			log.Printf("CreateFiles(): lock obtained, but timestamps missmatch: %d - %d\n", ts,chts)
 			filelock <- chts
-			return
+			return fmt.Errorf("lock obtained, but timestamps missmatch: %d - %d", ts, chts)
 		}
 	}
 	//Lock obtained proper, create/delete the files
-	err = adrefiles(fS)
+	err = adrefiles(ctx, fS)
+	if errors.Is(err, context.Canceled) {
+		//The definition must describe the files actually present
+		nfiles, tfsize, errc := fS.recount()
+		if errc != nil {
+			return fmt.Errorf("request cancelled, could not count the files: %s", errc.Error())
+		}
+		log.Printf("CreateFiles(): Request %d cancelled after %d seconds, holding %d bytes in %d files\n",ts,int64(time.Since(lt).Seconds()),tfsize,nfiles)
+		return fmt.Errorf("request cancelled, holding %d bytes in %d files: %w", tfsize, nfiles, err)
+	}
 	if err != nil {
 		log.Printf("CreateFiles(): Error creating file: %s\n",err.Error())
-		return
+		return err
 	}
 	log.Printf("CreateFiles(): Request %d completed in %d seconds\n",ts,int64(time.Since(lt).Seconds()))
+	return nil
 }
 
-//Add or remove files match the files definition in the FileCollection struct
-func adrefiles(fS *FileCollection) error {
+//Add or remove files match the files definition in the FileCollection struct.  Stops before the next file if ctx is cancelled
+func adrefiles(ctx context.Context, fS *FileCollection) error {
+	base := fS.GetRandStr()
 	for index,value := range fS.fileSizes {
-		directory := fmt.Sprintf("%s/d-%d",fS.frandi,value)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		directory := fmt.Sprintf("%s/d-%d",base,value)
 		//Create a list of files in directory
 		fileList,err := getFilesInDir(directory)
 		if err != nil {
@@ -253,7 +462,10 @@ func adrefiles(fS *FileCollection) error {
 			fdelta = deltasize / value
 			log.Printf("- Need to remove %d bytes, %d files of size %d",deltasize,fdelta,value)
 			for n:=0;n<int(fdelta);n++{
-				filename := fmt.Sprintf("%s/d-%d/f-%d",fS.frandi,value,int(lastfnum)-n)
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				filename := fmt.Sprintf("%s/d-%d/f-%d",base,value,int(lastfnum)-n)
 				err = os.Remove(filename)
 				if err != nil {
 					log.Printf("adrefiles(): error deleting file %s:",filename)
@@ -265,8 +477,11 @@ func adrefiles(fS *FileCollection) error {
 			fdelta = deltasize / value
 			log.Printf("+ Need to add %d bytes, %d files of size %d",deltasize,fdelta,value)
 			for n:=1;n<=int(fdelta);n++ {
-				filename := fmt.Sprintf("%s/d-%d/f-%d",fS.frandi,value,n+int(lastfnum))
-				err = newFile(filename,value)
+				if err = ctx.Err(); err != nil {
+					return err
+				}
+				filename := fmt.Sprintf("%s/d-%d/f-%d",base,value,n+int(lastfnum))
+				err = newFile(ctx,filename,value,fS.content,fS.mode)
 				if err != nil {
 					log.Printf("adrefiles(): error creating file %s:",filename)
 					return err
@@ -279,40 +494,91 @@ func adrefiles(fS *FileCollection) error {
 	return nil
 }
 
-//Creates a single file of the indicated size
-func newFile(filename string, size uint64) error {
-	const blength int = 1024
-	burval := make([]byte,blength)
-	var base [blength]byte
-	var counter, index uint64
-	//Fill up the base array with random printable characters
-	rand.Seed(time.Now().UnixNano())
-	for x:=0; x<len(base); x++ {
-		base[x]=byte(rand.Intn(95) + 32) //ASCII 32 to 126
-	}
+//Creates a single file of the indicated size, with data generated as defined by content.
+//mode defines if the data is actually written or the file is just given its size.  If ctx is cancelled while
+//the data is written the file is removed
+func newFile(ctx context.Context, filename string, size uint64, content FileContent, mode string) error {
 	f,err := os.Create(filename)
-	defer f.Close()
 	if err != nil {
 		log.Printf("newFile(): Error creating file: %s",filename)
 		return err
 	}
-	burval = base[:]
-	for i:=uint64(0); i<size; i++ {
-		counter += i + uint64(base[i%uint64(blength)])
-		index = counter%uint64(len(base))
-		burval[i%uint64(len(base))]=base[index]
-		if i%uint64(blength) == 0 {
-			_,err = f.Write(burval)
-			if err != nil {
-				log.Printf("newFile(): Error writing to file: %s",filename)
-				return err
-			}
-			counter = uint64(rand.Intn(blength))
+	defer f.Close()
+	switch mode {
+	case ModeFallocate:
+		err = syscall.Fallocate(int(f.Fd()), 0, 0, int64(size))
+		if err != nil {
+			log.Printf("newFile(): Error allocating space for file: %s",filename)
+		}
+		return err
+	case ModeSparse:
+		err = f.Truncate(int64(size))
+		if err != nil {
+			log.Printf("newFile(): Error setting size of sparse file: %s",filename)
+		}
+		return err
+	}
+	block := make([]byte,wblock)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var base [1024]byte
+	if content.kind == ContentAscii {
+		//Fill up the base array with random printable characters
+		for x:=0; x<len(base); x++ {
+			base[x]=byte(rnd.Intn(95) + 32) //ASCII 32 to 126
 		}
 	}
+	for written:=uint64(0); written<size; {
+		if err = ctx.Err(); err != nil {
+			log.Printf("newFile(): Cancelled after writing %d bytes, removing file: %s",written,filename)
+			os.Remove(filename)
+			return err
+		}
+		bsize := wblock
+		if size-written < bsize {
+			bsize = size-written
+		}
+		switch content.kind {
+		case ContentZero: //The block is never modified, so it stays zeroed
+		case ContentRandom:
+			randomBlock(block[:bsize],content.ratio,rnd)
+		default:
+			asciiBlock(block[:bsize],&base,rnd)
+		}
+		_,err = f.Write(block[:bsize])
+		if err != nil {
+			log.Printf("newFile(): Error writing to file: %s",filename)
+			return err
+		}
+		written += bsize
+	}
 	return nil
 }
 
+//Fills the block with pseudo random bytes.  Only 1/ratio of the block is random and the rest is set to zero,
+//so a compression algorithm can reduce the block to roughly 1/ratio of its size
+func randomBlock(block []byte, ratio uint64, rnd *rand.Rand) {
+	rsize := uint64(len(block)) / ratio
+	rnd.Read(block[:rsize])
+	for i:=rsize; i<uint64(len(block)); i++ {
+		block[i] = 0
+	}
+}
+
+//Fills the block with printable characters picked from the base array
+func asciiBlock(block []byte, base *[1024]byte, rnd *rand.Rand) {
+	var counter, index uint64
+	blength := uint64(len(base))
+	for i:=uint64(0); i<uint64(len(block)); i++ {
+		//This psuedo random algorith is explained in the documentation
+		counter += i + uint64(base[i%blength])
+		index = counter%blength
+		block[i]=base[index]
+		if i%blength == 0 {
+			counter = uint64(rnd.Intn(int(blength)))
+		}
+	}
+}
+
 //Returns a list of regular files with the correct name, in the directory specified, without 
 //directories or other types of files
 func getFilesInDir(directory string) ([]os.FileInfo,error) {
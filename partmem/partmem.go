@@ -1,15 +1,27 @@
 package partmem
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"math"
 	"math/rand"
+	"os"
+	"sync"
 	"time"
 )
 
 //Number of parts of every size to aim for
 const limitParts uint64 = 20
 
+//Ways to fill the memory parts with data
+const (
+	FillZero = "zero" //Allocated but untouched pages
+	FillTouch = "touch" //One byte written per page, so the pages become resident
+	FillRandom = "random" //Fast pseudo random bytes
+	FillAscii = "ascii" //Printable ASCII characters, slower
+)
+
 //Defines the individual component holding the data, and a pointer to the next one
 type apart struct {
 	data []byte
@@ -26,32 +38,240 @@ type PartCollection struct {
 	partLists []*apart
 	//Last request ID
 	lid int64
+	//Progress of the last request, shared by all copies of the collection
+	progress *memProgress
+}
+
+//Progress of a memory request.  Can be read while the parts are being created, without the lock channel
+type memProgress struct {
+	mutex sync.Mutex
+	//Request ID
+	id int64
+	//Fill mode of the request
+	fill string
+	//Time when the parts creation started and ended
+	start time.Time
+	end time.Time
+	//Bytes held when the request started, bytes requested and bytes held now
+	initial uint64
+	target uint64
+	current uint64
+	//Number of parts of each size held now
+	counts []uint64
+	//The request was cancelled before reaching the target
+	cancelled bool
+}
+
+//Reset the progress for a new request
+func (mp *memProgress) begin(id int64, fill string, counts []uint64, initial uint64, target uint64) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.id = id
+	mp.fill = fill
+	mp.start = time.Now()
+	mp.end = time.Time{}
+	mp.initial = initial
+	mp.target = target
+	mp.current = initial
+	mp.counts = counts
+	mp.cancelled = false
+}
+
+//Record a new part of the size at index
+func (mp *memProgress) added(index int, size uint64) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.counts[index]++
+	mp.current += size
+}
+
+//Record the number of parts of each size and bytes held
+func (mp *memProgress) recount(counts []uint64, current uint64) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.counts = counts
+	mp.current = current
+}
+
+//Mark the request as cancelled, the parts held are kept
+func (mp *memProgress) cancel() {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.cancelled = true
+}
+
+//Mark the request as completed
+func (mp *memProgress) finish() {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.end = time.Now()
+}
+
+//Progress of the current or last request, used in reports
+type Progress struct {
+	RequestID int64 `json:"request_id"`
+	State string `json:"state"` //running, cancelled or completed
+	Fill string `json:"fill"`
+	Allocated uint64 `json:"allocated"`
+	Target uint64 `json:"target"`
+	Percent float64 `json:"percent"`
+	Elapsed int64 `json:"elapsed_seconds"`
+	ETA int64 `json:"eta_seconds"` //Seconds to completion while running, -1 if unknown
+}
+
+//Get the progress of the current or last request
+//If id is not 0 it must match the ID of that request
+func (pc *PartCollection) GetProgress(id int64) (Progress, error) {
+	mp := pc.progress
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if mp.id == 0 {
+		return Progress{}, fmt.Errorf("No memory request has been processed yet")
+	}
+	if id != 0 && id != mp.id {
+		return Progress{}, fmt.Errorf("Request ID %d is not the current request, current request ID: %d", id, mp.id)
+	}
+	var elapsed time.Duration
+	prog := Progress{RequestID: mp.id, Fill: mp.fill, Allocated: mp.current, Target: mp.target}
+	if mp.end.IsZero() {
+		prog.State = "running"
+		elapsed = time.Since(mp.start)
+	} else if mp.cancelled {
+		prog.State = "cancelled"
+		elapsed = mp.end.Sub(mp.start)
+	} else {
+		prog.State = "completed"
+		elapsed = mp.end.Sub(mp.start)
+	}
+	prog.Elapsed = int64(elapsed.Seconds())
+	//Progress is measured on the distance between the initial and the target size
+	delta := math.Abs(float64(mp.target) - float64(mp.initial))
+	remain := math.Abs(float64(mp.target) - float64(mp.current))
+	prog.Percent = 100.0
+	if delta > 0 {
+		prog.Percent = math.Max(0, math.Min(100, (delta-remain)*100/delta))
+	}
+	if prog.State == "running" {
+		prog.ETA = -1
+		if prog.Percent > 0 {
+			prog.ETA = int64(time.Duration(float64(elapsed) * (100 - prog.Percent) / prog.Percent).Seconds())
+		}
+	}
+	return prog, nil
+}
+
+//Generate a message with the progress
+func (prog Progress) String() string {
+	mensj := fmt.Sprintf("Request ID: %d\nState: %s\nFill mode: %s\n", prog.RequestID, prog.State, prog.Fill)
+	mensj += fmt.Sprintf("Allocated: %d bytes of %d bytes (%.1f%%)\n", prog.Allocated, prog.Target, prog.Percent)
+	mensj += fmt.Sprintf("Elapsed time: %d seconds\n", prog.Elapsed)
+	if prog.State == "running" {
+		if prog.ETA >= 0 {
+			mensj += fmt.Sprintf("ETA: %d seconds\n", prog.ETA)
+		} else {
+			mensj += "ETA: unknown\n"
+		}
+	}
+	return mensj
+}
+
+//Number and total size of the parts of a single size, used in reports
+type PartCount struct {
+	Size uint64 `json:"size"`
+	Count uint64 `json:"count"`
+	TotalSize uint64 `json:"total_size"`
+}
+
+//Report about the memory parts, either defined or actually created
+type PartsReport struct {
+	RequestID int64 `json:"request_id"`
+	Parts []PartCount `json:"parts"`
+	TotalSize uint64 `json:"total_size"`
+}
+
+//Error returned when the size requested is over the limit
+type LimitError struct {
+	Requested uint64
+	Limit uint64
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("Size requested is over the limit: requested %d bytes, limit: %d bytes.", le.Requested, le.Limit)
 }
 
 //Computes the actual number of parts and its sizes
-func (pc PartCollection) GetActParts(dump string) string {
-	var mensj string
-	var totalSize uint64
-	mensj += fmt.Sprintf("Last request ID: %d\n",pc.lid)
+func (pc PartCollection) ActParts(dump string) PartsReport {
+	rep := PartsReport{RequestID: pc.lid}
 	for index, value := range pc.partLists {
-		count := 0 
-		mensj += fmt.Sprintf("Parts of size: %d, ", pc.partSizes[index])
+		pcount := PartCount{Size: pc.partSizes[index]}
 		for value != nil {
-			count++
-			totalSize += uint64(len(value.data))
+			pcount.Count++
+			pcount.TotalSize += uint64(len(value.data))
 			if dump == "true" {
 				log.Printf("\n\nPointer value:%v\nFile contents:\n%s",&value.next,value.data)
 			}
 			value = value.next
 		}
-		mensj += fmt.Sprintf("Count: %d\n", count)
+		rep.Parts = append(rep.Parts, pcount)
+		rep.TotalSize += pcount.TotalSize
 	}
-	mensj += fmt.Sprintf("Total size: %d bytes.\n",totalSize)
+	return rep
+}
+
+//Generate a message with the actual number of parts and its sizes
+func (pc PartCollection) GetActParts(dump string) string {
+	rep := pc.ActParts(dump)
+	mensj := fmt.Sprintf("Last request ID: %d\n",rep.RequestID)
+	for _, pcount := range rep.Parts {
+		mensj += fmt.Sprintf("Parts of size: %d, Count: %d\n", pcount.Size, pcount.Count)
+	}
+	mensj += fmt.Sprintf("Total size: %d bytes.\n",rep.TotalSize)
 	return mensj
 }
 
+//Get the ID of the current or last request that created parts
+func (pc *PartCollection) GetProgressID() int64 {
+	pc.progress.mutex.Lock()
+	defer pc.progress.mutex.Unlock()
+	return pc.progress.id
+}
+
+//Get the part sizes and the number of parts of each size held at this moment.
+//Safe to call while the parts are being created
+func (pc *PartCollection) HeldParts() ([]uint64, []uint64) {
+	pc.progress.mutex.Lock()
+	defer pc.progress.mutex.Unlock()
+	counts := make([]uint64, len(pc.partSizes))
+	copy(counts, pc.progress.counts)
+	return pc.partSizes, counts
+}
+
+//Returns the total size in bytes of the parts held at the moment, even while parts are being created
+func (pc *PartCollection) HeldSize() uint64 {
+	var tmsize uint64
+	sizes, counts := pc.HeldParts()
+	for index, size := range sizes {
+		tmsize += size * counts[index]
+	}
+	return tmsize
+}
+
+//Computes the number of parts of each size and the total size in bytes of the memory parts
+func (pc PartCollection) countParts() ([]uint64, uint64) {
+	var tmsize uint64
+	counts := make([]uint64, len(pc.partLists))
+	for index, value := range pc.partLists {
+		for value != nil {
+			counts[index]++
+			tmsize += uint64(len(value.data))
+			value = value.next
+		}
+	}
+	return counts, tmsize
+}
+
 //Computes the total size in bytes used up by the momory parts
-func (pc PartCollection) sizeOfParts() uint64 {
+func (pc PartCollection) SizeOfParts() uint64 {
 	var tmsize uint64
 	for _, value := range pc.partLists { //For every list of parts of each size
 		for value != nil { //Sum up the actual parts size
@@ -70,6 +290,7 @@ func NewpC() PartCollection {
 	pC.partSizes = []uint64{262144, 1048576, 4194304, 16777216, 67108864}
 	pC.partAmmount = make([]uint64, len(pC.partSizes))
 	pC.partLists = make([]*apart, len(pC.partSizes))
+	pC.progress = &memProgress{}
 	return pC
 }
 
@@ -79,10 +300,10 @@ func NewpC() PartCollection {
 func DefineParts(tsize uint64, hilimit uint64, ptS *PartCollection) error {
 	var nparts, remain, usedSize uint64
 
-	usedSize = ptS.sizeOfParts() //The memory being used up at the moment
+	usedSize = ptS.SizeOfParts() //The memory being used up at the moment
 
 	if tsize > usedSize && tsize > hilimit { //If the requested size bigger than the currently used memory, and the increment is bigger than the limit
-		return fmt.Errorf("Size requested is over the limit: requested %d bytes, limit: %d bytes.", tsize, hilimit)
+		return &LimitError{Requested: tsize, Limit: hilimit}
 	}
 	for index, psize := range ptS.partSizes {
 		nparts = tsize / psize
@@ -117,8 +338,33 @@ func DefineParts(tsize uint64, hilimit uint64, ptS *PartCollection) error {
 	return nil
 }
 
+//Check that the fill mode is one of the supported values
+func ValidFill(mode string) bool {
+	switch mode {
+	case FillZero, FillTouch, FillRandom, FillAscii:
+		return true
+	}
+	return false
+}
+
+//Fill the part array with data according to the fill mode
+func fillPart(part []byte, mode string) {
+	switch mode {
+	case FillZero: //Nothing to do, the memory returned by make() is already zeroed
+	case FillTouch:
+		pagesize := os.Getpagesize()
+		for x := 0; x < len(part); x += pagesize {
+			part[x] = 1
+		}
+	case FillRandom:
+		rand.New(rand.NewSource(time.Now().UnixNano())).Read(part)
+	default:
+		fillAscii(part)
+	}
+}
+
 //Fill the part array with random bytes from the writable section of the ASCI chart.
-func fillPart(part []byte) {
+func fillAscii(part []byte) {
 	const blength int = 1024
 	var base [blength]byte
 	var counter, index uint64
@@ -138,7 +384,9 @@ func fillPart(part []byte) {
 }
 
 //Create or remove parts to reach the expected number of parts as defined in the partCollection parameter
-func CreateParts(ptS *PartCollection, ts int64, lock chan int64) {
+//fill is the mode used to fill the new parts with data.  If ctx is cancelled no more parts are created, the parts already
+//created are kept and the definition is updated to match them.  Returns an error if the parts could not be created
+func CreateParts(ctx context.Context, ptS *PartCollection, ts int64, fill string, lock chan int64) error {
 	var pap *apart
 	var lt time.Time
 
@@ -146,7 +394,7 @@ func CreateParts(ptS *PartCollection, ts int64, lock chan int64) {
 	case <- time.After(5 * time.Second):
 		//If 5 seconds pass without getting the proper lock, abort
 		log.Printf("partmem.CreateParts(): timeout waiting for lock\n")
-		return
+		return fmt.Errorf("timeout waiting for lock")
 	case chts := <- lock:
 		if chts == ts { //Got the lock and it matches the timestamp received
 			//Proceed
@@ -159,11 +407,21 @@ func CreateParts(ptS *PartCollection, ts int64, lock chan int64) {
 		} else {
 			log.Printf("partmem.CreateParts(): lock obtained, but timestamps missmatch: %d - %d\n", ts,chts)
 			lock <- chts
-			return
+			return fmt.Errorf("lock obtained, but timestamps missmatch: %d - %d", ts, chts)
 		}
 	}
 
+	var target uint64
 	for index, value := range ptS.partSizes {
+		target += value * ptS.partAmmount[index]
+	}
+	counts, current := ptS.countParts()
+	ptS.progress.begin(ts, fill, counts, current, target)
+	defer ptS.progress.finish()
+	for index, value := range ptS.partSizes {
+		if ctx.Err() != nil {
+			break
+		}
 		desirednumParts := ptS.partAmmount[index]
 		pap = ptS.partLists[index]
 		if desirednumParts == 0 {
@@ -171,16 +429,21 @@ func CreateParts(ptS *PartCollection, ts int64, lock chan int64) {
 		} else if pap == nil && desirednumParts > 0 { //Create the first element
 			var newpart apart
 			newpart.data = make([]byte, value)
-			fillPart(newpart.data)
+			fillPart(newpart.data, fill)
 			ptS.partLists[index] = &newpart
 			pap = &newpart
+			ptS.progress.added(index, value)
 		}
-		for i := uint64(1); i < desirednumParts; i++ {
+		for i := uint64(1); i < desirednumParts && pap != nil; i++ {
 			if pap.next == nil {
+				if ctx.Err() != nil {
+					break
+				}
 				var newpart apart
 				newpart.data = make([]byte, value)
-				fillPart(newpart.data)
+				fillPart(newpart.data, fill)
 				pap.next = &newpart
+				ptS.progress.added(index, value)
 			}
 			if pap != nil {
 				pap = pap.next
@@ -189,18 +452,51 @@ func CreateParts(ptS *PartCollection, ts int64, lock chan int64) {
 		if pap != nil && desirednumParts > 0 {
 			pap.next = nil
 		} 
+		//Account for the parts released from this list
+		ptS.progress.recount(ptS.countParts())
+	}
+	if err := ctx.Err(); err != nil {
+		//The definition must describe the parts actually held
+		counts, current := ptS.countParts()
+		ptS.partAmmount = counts
+		ptS.progress.cancel()
+		log.Printf("CreateParts(): Request %d cancelled after %d seconds, holding %d bytes\n", ts, int64(time.Since(lt).Seconds()), current)
+		return fmt.Errorf("request cancelled, holding %d bytes: %w", current, err)
 	}
 	log.Printf("CreateParts(): Request %d completed in %d seconds\n",ts,int64(time.Since(lt).Seconds()))
+	return nil
+}
+
+//Releases all the memory parts.  Returns the number of parts and bytes released.  Must be called with the lock held
+func (pc *PartCollection) Release() (uint64, uint64) {
+	counts, current := pc.countParts()
+	var nparts uint64
+	for index := range pc.partLists {
+		nparts += counts[index]
+		pc.partLists[index] = nil
+		pc.partAmmount[index] = 0
+	}
+	pc.progress.recount(make([]uint64, len(pc.partSizes)), 0)
+	return nparts, current
+}
+
+//Computes the number of _apart_ elements defined
+func DefParts(pS *PartCollection) PartsReport {
+	rep := PartsReport{RequestID: pS.lid}
+	for index, value := range pS.partSizes {
+		rep.Parts = append(rep.Parts, PartCount{Size: value, Count: pS.partAmmount[index], TotalSize: value*pS.partAmmount[index]})
+		rep.TotalSize += value * pS.partAmmount[index]
+	}
+	return rep
 }
 
 //Prints the number of _apart_ elements defined
 func GetDefParts (pS *PartCollection) string {
-	var semiTotal uint64
 	var rst string
-	for index, value := range pS.partSizes {
-		semiTotal += value * pS.partAmmount[index]
-		rst += fmt.Sprintf("Boxes of size: %d, count: %d, total size: %d\n", value, pS.partAmmount[index], value*pS.partAmmount[index])
+	rep := DefParts(pS)
+	for _, pcount := range rep.Parts {
+		rst += fmt.Sprintf("Boxes of size: %d, count: %d, total size: %d\n", pcount.Size, pcount.Count, pcount.TotalSize)
 	}
-	rst += fmt.Sprintf("Total size reserved: %d bytes.\n", semiTotal)
+	rst += fmt.Sprintf("Total size reserved: %d bytes.\n", rep.TotalSize)
 	return rst
-}
\ No newline at end of file
+}
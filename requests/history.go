@@ -0,0 +1,195 @@
+package requests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+//Format of the times shown in reports
+const timeFormat = time.RFC3339Nano
+
+//Information about a request
+type Record struct {
+	ID int64 `json:"id"`
+	Params string `json:"params"` //Description of the parameters of the request
+	State string `json:"state"`
+	Error string `json:"error,omitempty"`
+	Code string `json:"code,omitempty"` //Error code of the API, like over_limit, if the error has one
+	Position int `json:"position,omitempty"` //Position in the queue, 1 for the next request to run
+	Submitted time.Time `json:"submitted"`
+	Start time.Time `json:"start"` //Zero while queued
+	End time.Time `json:"end"` //Zero while queued or running
+}
+
+//Time the request has been running, or took to run if it is finished
+func (r Record) Duration() time.Duration {
+	switch {
+	case r.Start.IsZero():
+		return 0
+	case r.End.IsZero():
+		return time.Since(r.Start)
+	}
+	return r.End.Sub(r.Start)
+}
+
+//Encodes the record with the times that are not set omitted, and the duration in seconds
+func (r Record) MarshalJSON() ([]byte, error) {
+	type plain Record //Same fields without the methods, to avoid recursion
+	out := struct {
+		plain
+		Start string `json:"start,omitempty"`
+		End string `json:"end,omitempty"`
+		Duration float64 `json:"duration_seconds"`
+	}{plain: plain(r), Duration: r.Duration().Seconds()}
+	if !r.Start.IsZero() {
+		out.Start = r.Start.Format(timeFormat)
+	}
+	if !r.End.IsZero() {
+		out.End = r.End.Format(timeFormat)
+	}
+	return json.Marshal(out)
+}
+
+//Multiline description of the request
+func (r Record) String() string {
+	mensj := fmt.Sprintf("Request ID: %d\nParameters: %s\nState: %s\n", r.ID, r.Params, r.State)
+	if r.Position > 0 {
+		mensj += fmt.Sprintf("Position in the queue: %d\n", r.Position)
+	}
+	mensj += fmt.Sprintf("Submitted: %s\n", r.Submitted.Format(timeFormat))
+	if !r.Start.IsZero() {
+		mensj += fmt.Sprintf("Started: %s\n", r.Start.Format(timeFormat))
+	}
+	if !r.End.IsZero() {
+		mensj += fmt.Sprintf("Ended: %s\n", r.End.Format(timeFormat))
+	}
+	if !r.Start.IsZero() {
+		mensj += fmt.Sprintf("Duration: %s\n", r.Duration().Round(time.Millisecond))
+	}
+	if r.Error != "" {
+		mensj += fmt.Sprintf("Error: %s\n", r.Error)
+	}
+	if r.Code != "" {
+		mensj += fmt.Sprintf("Error code: %s\n", r.Code)
+	}
+	return mensj
+}
+
+//Single line description of the request, used in lists
+func (r Record) Line() string {
+	mensj := fmt.Sprintf("ID: %d, state: %s, submitted: %s, duration: %s, parameters: %s", r.ID, r.State,
+		r.Submitted.Format(timeFormat), r.Duration().Round(time.Millisecond), r.Params)
+	if r.Error != "" {
+		mensj += fmt.Sprintf(", error: %s", r.Error)
+	}
+	return mensj + "\n"
+}
+
+//Bounded history of the requests of a subsystem.  When the limit is reached the oldest finished requests are forgotten
+type History struct {
+	mutex sync.Mutex
+	records map[int64]*Record
+	order []int64 //IDs of the requests, oldest first
+	limit int //Maximum number of finished requests kept
+}
+
+//Creates an empty history that keeps up to limit finished requests
+func NewHistory(limit int) *History {
+	return &History{records: make(map[int64]*Record), limit: limit}
+}
+
+//Adds a request to the history in the state specified
+func (h *History) Add(id int64, params string, state string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.records[id] = &Record{ID: id, Params: params, State: state, Submitted: time.Now()}
+	h.order = append(h.order, id)
+	h.trim()
+}
+
+//Marks the request as running
+func (h *History) Start(id int64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if rec, ok := h.records[id]; ok {
+		rec.State = Running
+		rec.Start = time.Now()
+	}
+}
+
+//Marks the request as done, or failed if err is not nil, or cancelled if err is caused by a cancelled context.
+//If err is or wraps a CodedError its code is recorded
+func (h *History) Finish(id int64, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	rec, ok := h.records[id]
+	if !ok {
+		return
+	}
+	var ce *CodedError
+	if errors.As(err, &ce) {
+		rec.Code = ce.Code
+	}
+	if errors.Is(err, context.Canceled) {
+		rec.State = Cancelled
+		rec.Error = err.Error()
+	} else if err != nil {
+		rec.State = Failed
+		rec.Error = err.Error()
+	} else {
+		rec.State = Done
+	}
+	rec.End = time.Now()
+	h.trim()
+}
+
+//Returns a copy of the request and true if it is known
+func (h *History) Get(id int64) (Record, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	rec, ok := h.records[id]
+	if !ok {
+		return Record{}, false
+	}
+	return *rec, true
+}
+
+//Returns a copy of all the requests known, newest first
+func (h *History) List() []Record {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	list := make([]Record, 0, len(h.order))
+	for i := len(h.order) - 1; i >= 0; i-- {
+		list = append(list, *h.records[h.order[i]])
+	}
+	return list
+}
+
+//Forgets the oldest finished requests over the limit.  Must be called with the mutex locked
+func (h *History) trim() {
+	finished := 0
+	for _, id := range h.order {
+		if isFinished(h.records[id].State) {
+			finished++
+		}
+	}
+	kept := h.order[:0]
+	for _, id := range h.order {
+		if finished > h.limit && isFinished(h.records[id].State) {
+			delete(h.records, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	h.order = kept
+}
+
+//True if the request in this state will not change anymore
+func isFinished(state string) bool {
+	return state == Done || state == Failed || state == Cancelled
+}
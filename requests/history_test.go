@@ -0,0 +1,69 @@
+package requests
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+//IDs of the requests in the history, oldest first
+func historyIDs(h *History) []int64 {
+	list := h.List()
+	ids := make([]int64, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		ids = append(ids, list[i].ID)
+	}
+	return ids
+}
+
+func TestHistoryTrim(t *testing.T) {
+	h := NewHistory(2)
+	for id := int64(1); id <= 5; id++ {
+		h.Add(id, "", Queued)
+	}
+	//Requests that are not finished are never forgotten
+	if ids := historyIDs(h); !reflect.DeepEqual(ids, []int64{1, 2, 3, 4, 5}) {
+		t.Fatalf("unfinished requests = %v, want all of them", ids)
+	}
+	h.Start(2)
+	h.Finish(2, nil)
+	h.Finish(4, fmt.Errorf("failed"))
+	h.Finish(1, fmt.Errorf("stopped"))
+	//Three finished requests with a limit of 2, the oldest one is forgotten
+	if ids := historyIDs(h); !reflect.DeepEqual(ids, []int64{2, 3, 4, 5}) {
+		t.Errorf("after finishing 1, 2 and 4 = %v, want [2 3 4 5]", ids)
+	}
+	h.Start(5)
+	h.Finish(5, nil)
+	if ids := historyIDs(h); !reflect.DeepEqual(ids, []int64{3, 4, 5}) {
+		t.Errorf("after finishing 5 = %v, want [3 4 5]", ids)
+	}
+	if _, ok := h.Get(2); ok {
+		t.Errorf("request 2 is still known after being forgotten")
+	}
+}
+
+func TestHistoryFinish(t *testing.T) {
+	tests := []struct {
+		err error
+		state, code string
+	}{
+		{nil, Done, ""},
+		{fmt.Errorf("no space left"), Failed, ""},
+		{fmt.Errorf("request cancelled: %w", context.Canceled), Cancelled, ""},
+		{WithCode("over_limit", fmt.Errorf("over the limit")), Failed, "over_limit"},
+		{fmt.Errorf("wrapped: %w", WithCode("over_limit", fmt.Errorf("over the limit"))), Failed, "over_limit"},
+	}
+	h := NewHistory(len(tests))
+	for index, tt := range tests {
+		id := int64(index)
+		h.Add(id, "", Queued)
+		h.Start(id)
+		h.Finish(id, tt.err)
+		rec, _ := h.Get(id)
+		if rec.State != tt.state || rec.Code != tt.code || rec.End.IsZero() {
+			t.Errorf("Finish(%v) = state %s, code %q, want state %s, code %q", tt.err, rec.State, rec.Code, tt.state, tt.code)
+		}
+	}
+}
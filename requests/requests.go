@@ -0,0 +1,232 @@
+package requests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+//States of a request
+const (
+	Queued = "queued" //Waiting for the previous requests to finish
+	Running = "running" //Being processed
+	Done = "done" //Completed successfully
+	Failed = "failed" //Completed with an error, or replaced while queued
+	Cancelled = "cancelled" //Cancelled while queued or running
+)
+
+//Policies applied when a request arrives while others are queued or running
+const (
+	PolicyQueue = "queue" //Wait behind the other requests
+	PolicyReplace = "replace" //Discard the queued requests and wait for the running one
+	PolicyReject = "reject" //Fail immediately
+)
+
+//Maximum number of finished requests remembered by every subsystem
+const HistorySize = 100
+
+//Error returned when a request is rejected because the queue is not empty
+var ErrRejected = errors.New("another request is queued or running")
+
+//Error returned when a request is submitted after the queue is closed
+var ErrClosed = errors.New("the server is shutting down")
+
+//Errors returned when a request cannot be cancelled
+var ErrUnknown = errors.New("unknown request")
+var ErrFinished = errors.New("the request is already finished")
+
+//Error with the code of the API that describes it, recorded in the history of the request
+type CodedError struct {
+	Code string
+	Err error
+}
+
+func (ce *CodedError) Error() string {
+	return ce.Err.Error()
+}
+
+func (ce *CodedError) Unwrap() error {
+	return ce.Err
+}
+
+//Adds the code to the error, nil if err is nil
+func WithCode(code string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &CodedError{Code: code, Err: err}
+}
+
+//Check if the policy is valid
+func ValidPolicy(policy string) bool {
+	return policy == PolicyQueue || policy == PolicyReplace || policy == PolicyReject
+}
+
+//A request waiting to run
+type job struct {
+	id int64
+	run func(ctx context.Context) error
+	cancel context.CancelFunc //Cancels the context of the request, set when it starts running
+}
+
+//FIFO queue of requests that are run one at a time in the background
+type Queue struct {
+	name string //Name used in log messages
+	mutex sync.Mutex
+	pending []*job //Requests waiting to run, the first one runs next
+	running *job //Request being run, nil if none
+	history *History //All the requests known
+	wake chan struct{} //Signals the worker that a request was added
+	closed bool //No more requests are accepted
+	ctx context.Context //Parent of the contexts of the requests
+}
+
+//Creates a queue and starts its worker.  Cancelling ctx cancels the request running
+func NewQueue(ctx context.Context, name string) *Queue {
+	q := &Queue{name: name, history: NewHistory(HistorySize), wake: make(chan struct{}, 1), ctx: ctx}
+	go q.worker()
+	return q
+}
+
+//Adds a request to the queue according to the policy.  The run function is called in the background when the request reaches the head of the queue,
+//it must stop when its context is cancelled
+func (q *Queue) Submit(id int64, params string, policy string, run func(ctx context.Context) error) (Record, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return Record{}, ErrClosed
+	}
+	switch policy {
+	case PolicyReject:
+		if q.running != nil || len(q.pending) > 0 {
+			return Record{}, ErrRejected
+		}
+	case PolicyReplace:
+		for _, pj := range q.pending {
+			log.Printf("requests.Submit(): %s request %d replaced by request %d", q.name, pj.id, id)
+			q.history.Finish(pj.id, fmt.Errorf("replaced by request %d", id))
+		}
+		q.pending = nil
+	}
+	q.history.Add(id, params, Queued)
+	q.pending = append(q.pending, &job{id: id, run: run})
+	select {
+	case q.wake <- struct{}{}:
+	default: //The worker has already been signaled
+	}
+	return q.get(id), nil
+}
+
+//Stops accepting requests and fails the ones waiting in the queue.  The request running, if any, is not affected
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	for _, pj := range q.pending {
+		log.Printf("requests.Close(): %s request %d discarded", q.name, pj.id)
+		q.history.Finish(pj.id, ErrClosed)
+	}
+	q.pending = nil
+}
+
+//Cancels a request.  A queued request is removed from the queue, a running request is asked to stop and
+//is marked as cancelled when its run function returns
+func (q *Queue) Cancel(id int64) (Record, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for index, pj := range q.pending {
+		if pj.id == id {
+			log.Printf("requests.Cancel(): %s request %d cancelled while queued", q.name, id)
+			q.pending = append(q.pending[:index], q.pending[index+1:]...)
+			q.history.Finish(id, fmt.Errorf("cancelled while queued: %w", context.Canceled))
+			return q.get(id), nil
+		}
+	}
+	if q.running != nil && q.running.id == id {
+		log.Printf("requests.Cancel(): %s request %d cancelled while running", q.name, id)
+		q.running.cancel()
+		return q.get(id), nil
+	}
+	rec := q.get(id)
+	if rec.ID == 0 {
+		return rec, ErrUnknown
+	}
+	return rec, ErrFinished
+}
+
+//Returns the information about a request and true if it is known
+func (q *Queue) Get(id int64) (Record, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	rec := q.get(id)
+	return rec, rec.ID != 0
+}
+
+//Returns all the requests known, newest first
+func (q *Queue) List() []Record {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	list := q.history.List()
+	for index := range list {
+		list[index].Position = q.position(list[index].ID)
+	}
+	return list
+}
+
+//Returns the number of requests queued and true if there is one running
+func (q *Queue) Length() (int, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.pending), q.running != nil
+}
+
+//Copy of the record with its position in the queue, with ID 0 if it is not known.  Must be called with the mutex locked
+func (q *Queue) get(id int64) Record {
+	rec, _ := q.history.Get(id)
+	rec.Position = q.position(id)
+	return rec
+}
+
+//Position of the request in the queue, 0 if it is not queued.  Must be called with the mutex locked
+func (q *Queue) position(id int64) int {
+	for index, pj := range q.pending {
+		if pj.id == id {
+			return index + 1
+		}
+	}
+	return 0
+}
+
+//Runs the queued requests one at a time, in order of arrival
+func (q *Queue) worker() {
+	for range q.wake {
+		for {
+			q.mutex.Lock()
+			if len(q.pending) == 0 {
+				q.mutex.Unlock()
+				break
+			}
+			q.running = q.pending[0]
+			q.pending = q.pending[1:]
+			q.history.Start(q.running.id)
+			ctx, cancel := context.WithCancel(q.ctx)
+			q.running.cancel = cancel
+			rj := q.running
+			q.mutex.Unlock()
+
+			err := rj.run(ctx)
+			cancel()
+			if errors.Is(err, context.Canceled) {
+				log.Printf("requests.worker(): %s request %d cancelled: %s", q.name, rj.id, err.Error())
+			} else if err != nil {
+				log.Printf("requests.worker(): %s request %d failed: %s", q.name, rj.id, err.Error())
+			}
+			q.mutex.Lock()
+			q.history.Finish(rj.id, err)
+			q.running = nil
+			q.mutex.Unlock()
+		}
+	}
+}
@@ -0,0 +1,307 @@
+package scenario
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tale-toul/testero/cpuload"
+	"github.com/tale-toul/testero/partdisk"
+	"github.com/tale-toul/testero/partmem"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//States of a scenario run
+const (
+	Running = "running"
+	Paused = "paused"
+	Completed = "completed" //All the steps have been run
+	Aborted = "aborted"
+)
+
+//States of a step
+const (
+	StepPending = "pending"
+	StepDone = "done" //The request was accepted, check its ID for the final result
+	StepFailed = "failed"
+	StepSkipped = "skipped" //The scenario was aborted before the step was run
+)
+
+//Error returned when there is no scenario to pause, resume, abort or report
+var ErrNoScenario = errors.New("no scenario has been started")
+
+//Operations the scenario drives, implemented by the application.  The functions return the ID of the request created
+type Executor interface {
+	SetMemory(size uint64, fill string) (int64, error)
+	SetDisk(size uint64, content partdisk.FileContent, mode string) (int64, error)
+	StartCPU(duration uint64, workers int, profile cpuload.LoadProfile) (int64, error)
+	StopCPU() error
+}
+
+//Result of a step
+type StepStatus struct {
+	At string `json:"at"`
+	Step string `json:"step"`
+	State string `json:"state"`
+	RequestIDs []int64 `json:"request_ids,omitempty"`
+	Error string `json:"error,omitempty"`
+	Executed string `json:"executed,omitempty"`
+}
+
+//State of the current or last scenario run
+type Status struct {
+	Name string `json:"name"`
+	State string `json:"state"`
+	Started string `json:"started"`
+	Elapsed float64 `json:"elapsed_seconds"` //Time running, not counting the pauses
+	Steps []StepStatus `json:"steps"`
+}
+
+//A run of a scenario
+type run struct {
+	mutex sync.Mutex
+	scenario *Scenario
+	state string
+	steps []StepStatus
+	next int //Index of the next step to run
+	started time.Time
+	elapsed time.Duration //Time running until the last pause
+	resumed time.Time //When the run was started or resumed for the last time
+	wake chan struct{} //Signals a change of state to the scheduler
+}
+
+//Schedules the steps of one scenario at a time
+type Runner struct {
+	mutex sync.Mutex
+	exec Executor
+	current *run //Current or last run, nil if no scenario has been started
+}
+
+//Creates a runner that uses exec to run the steps
+func NewRunner(exec Executor) *Runner {
+	return &Runner{exec: exec}
+}
+
+//Starts running a scenario, if no other is running or paused
+func (rn *Runner) Start(sc *Scenario) error {
+	rn.mutex.Lock()
+	defer rn.mutex.Unlock()
+	if rn.current != nil {
+		if state := rn.current.getState(); state == Running || state == Paused {
+			return fmt.Errorf("scenario %q is %s, abort it first", rn.current.scenario.Name, state)
+		}
+	}
+	now := time.Now()
+	rs := &run{scenario: sc, state: Running, started: now, resumed: now, wake: make(chan struct{}, 1)}
+	for _, st := range sc.Steps {
+		rs.steps = append(rs.steps, StepStatus{At: st.At, Step: st.String(), State: StepPending})
+	}
+	rn.current = rs
+	log.Printf("scenario.Start(): Starting scenario %q with %d steps", sc.Name, len(sc.Steps))
+	go rn.schedule(rs)
+	return nil
+}
+
+//Pauses the timeline of the running scenario.  The requests already sent are not affected
+func (rn *Runner) Pause() error {
+	return rn.change(Running, func(rs *run) {
+		rs.elapsed += time.Since(rs.resumed)
+		rs.state = Paused
+	})
+}
+
+//Resumes the timeline of a paused scenario
+func (rn *Runner) Resume() error {
+	return rn.change(Paused, func(rs *run) {
+		rs.resumed = time.Now()
+		rs.state = Running
+	})
+}
+
+//Aborts the running or paused scenario, the steps not run yet are skipped.  The requests already sent are not affected
+func (rn *Runner) Abort() error {
+	err := rn.change(Running, rn.abort)
+	if err != nil {
+		err = rn.change(Paused, rn.abort)
+	}
+	return err
+}
+
+//Marks the run as aborted.  Must be called with the mutex of the run locked
+func (rn *Runner) abort(rs *run) {
+	if rs.state == Running {
+		rs.elapsed += time.Since(rs.resumed)
+	}
+	rs.state = Aborted
+	for index := rs.next; index < len(rs.steps); index++ {
+		rs.steps[index].State = StepSkipped
+	}
+}
+
+//Applies a change to the current run if it is in the state expected, and wakes up the scheduler
+func (rn *Runner) change(expected string, apply func(*run)) error {
+	rn.mutex.Lock()
+	rs := rn.current
+	rn.mutex.Unlock()
+	if rs == nil {
+		return ErrNoScenario
+	}
+	rs.mutex.Lock()
+	if rs.state != expected {
+		state := rs.state
+		rs.mutex.Unlock()
+		return fmt.Errorf("scenario %q is %s", rs.scenario.Name, state)
+	}
+	apply(rs)
+	log.Printf("scenario.change(): Scenario %q is %s", rs.scenario.Name, rs.state)
+	rs.mutex.Unlock()
+	select {
+	case rs.wake <- struct{}{}:
+	default: //The scheduler has already been signaled
+	}
+	return nil
+}
+
+//Returns the state of the current or last run, and false if no scenario has been started
+func (rn *Runner) Status() (Status, bool) {
+	rn.mutex.Lock()
+	rs := rn.current
+	rn.mutex.Unlock()
+	if rs == nil {
+		return Status{}, false
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	status := Status{Name: rs.scenario.Name, State: rs.state, Started: rs.started.Format(time.RFC3339), Elapsed: rs.getElapsed().Seconds()}
+	status.Steps = append(status.Steps, rs.steps...)
+	return status, true
+}
+
+//Multiline description of the status
+func (st Status) String() string {
+	mensj := fmt.Sprintf("Scenario: %s\nState: %s\nStarted: %s\nElapsed: %s\n", st.Name, st.State, st.Started, time.Duration(st.Elapsed*float64(time.Second)).Round(time.Second))
+	for index, step := range st.Steps {
+		mensj += fmt.Sprintf("Step %d at %s: %s, %s", index+1, step.At, step.Step, step.State)
+		if len(step.RequestIDs) > 0 {
+			ids := make([]string, len(step.RequestIDs))
+			for i, id := range step.RequestIDs {
+				ids[i] = fmt.Sprint(id)
+			}
+			mensj += fmt.Sprintf(", id: %s", strings.Join(ids, ", "))
+		}
+		if step.Error != "" {
+			mensj += fmt.Sprintf(", error: %s", step.Error)
+		}
+		mensj += "\n"
+	}
+	return mensj
+}
+
+//Returns the state of the run
+func (rs *run) getState() string {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	return rs.state
+}
+
+//Time running, not counting the pauses.  Must be called with the mutex locked
+func (rs *run) getElapsed() time.Duration {
+	if rs.state == Running {
+		return rs.elapsed + time.Since(rs.resumed)
+	}
+	return rs.elapsed
+}
+
+//Runs every step when its time comes, until all are run or the scenario is aborted
+func (rn *Runner) schedule(rs *run) {
+	for {
+		rs.mutex.Lock()
+		if rs.state == Aborted {
+			rs.mutex.Unlock()
+			return
+		}
+		if rs.next >= len(rs.steps) {
+			rs.elapsed = rs.getElapsed()
+			rs.state = Completed
+			rs.mutex.Unlock()
+			log.Printf("scenario.schedule(): Scenario %q completed", rs.scenario.Name)
+			return
+		}
+		var timer <-chan time.Time //Stays nil while paused, so only a change of state wakes up the scheduler
+		if rs.state == Running {
+			wait := rs.scenario.Steps[rs.next].offset - rs.getElapsed()
+			if wait <= 0 {
+				index := rs.next
+				rs.next++
+				rs.mutex.Unlock()
+				rn.runStep(rs, index)
+				continue
+			}
+			timer = time.After(wait)
+		}
+		rs.mutex.Unlock()
+		select {
+		case <-timer:
+		case <-rs.wake:
+		}
+	}
+}
+
+//Runs a single step and records its result
+func (rn *Runner) runStep(rs *run, index int) {
+	st := rs.scenario.Steps[index]
+	var ids []int64
+	var err error
+	var id int64
+	log.Printf("scenario.runStep(): Scenario %q step %d at %s: %s", rs.scenario.Name, index+1, st.At, st)
+	switch st.Action {
+	case ActionMem:
+		id, err = rn.exec.SetMemory(st.size, st.Fill)
+		ids = append(ids, id)
+	case ActionDisk:
+		id, err = rn.exec.SetDisk(st.size, st.content, st.Mode)
+		ids = append(ids, id)
+	case ActionCpu:
+		id, err = rn.exec.StartCPU(st.duration, st.Workers, st.profile)
+		ids = append(ids, id)
+	case ActionCpuStop:
+		err = rn.exec.StopCPU()
+	case ActionRelease:
+		var errs []string
+		if id, err = rn.exec.SetMemory(0, partmem.FillAscii); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			ids = append(ids, id)
+		}
+		content, _ := partdisk.NewContent(partdisk.ContentAscii, 0)
+		if id, err = rn.exec.SetDisk(0, content, partdisk.ModeWrite); err != nil {
+			errs = append(errs, err.Error())
+		} else {
+			ids = append(ids, id)
+		}
+		if err = rn.exec.StopCPU(); err != nil {
+			errs = append(errs, err.Error())
+		}
+		err = nil
+		if len(errs) > 0 {
+			err = fmt.Errorf("%s", strings.Join(errs, "; "))
+		}
+	}
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+	result := &rs.steps[index]
+	result.Executed = time.Now().Format(time.RFC3339)
+	if err != nil {
+		log.Printf("scenario.runStep(): Scenario %q step %d failed: %s", rs.scenario.Name, index+1, err.Error())
+		result.State = StepFailed
+		result.Error = err.Error()
+	} else {
+		result.State = StepDone
+	}
+	for _, id := range ids {
+		if id != 0 {
+			result.RequestIDs = append(result.RequestIDs, id)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package scenario
+
+import (
+	"fmt"
+	"github.com/tale-toul/testero/cpuload"
+	"github.com/tale-toul/testero/partdisk"
+	"github.com/tale-toul/testero/partmem"
+	"github.com/tale-toul/testero/units"
+	"gopkg.in/yaml.v3"
+	"sort"
+	"strings"
+	"time"
+)
+
+//Actions that a step can run
+const (
+	ActionMem = "mem" //Set the memory held to size
+	ActionDisk = "disk" //Set the size of the files to size
+	ActionCpu = "cpu" //Start a CPU load for duration, stopping the current one if any
+	ActionCpuStop = "cpu-stop" //Stop the current CPU load
+	ActionRelease = "release" //Release all the memory and files and stop the CPU load
+)
+
+//A step of the timeline.  All the fields are strings or numbers so they can be written in YAML or JSON
+type Step struct {
+	At string `yaml:"at" json:"at"` //Time since the start of the scenario, like 0, 30s or 2m
+	Action string `yaml:"action" json:"action"`
+	Size string `yaml:"size,omitempty" json:"size,omitempty"` //Size for mem and disk, like 512Mi or 2G
+	Fill string `yaml:"fill,omitempty" json:"fill,omitempty"` //Fill mode for mem
+	Content string `yaml:"content,omitempty" json:"content,omitempty"` //Content for disk
+	Mode string `yaml:"mode,omitempty" json:"mode,omitempty"` //Creation mode for disk
+	Duration string `yaml:"duration,omitempty" json:"duration,omitempty"` //Load time for cpu, like 5m
+	Workers int `yaml:"workers,omitempty" json:"workers,omitempty"` //Number of workers for cpu, 0 for the default
+	Percent uint32 `yaml:"percent,omitempty" json:"percent,omitempty"` //Flat load for cpu, 100 by default
+	Profile string `yaml:"profile,omitempty" json:"profile,omitempty"` //Load profile for cpu: ramp, step, sine or square
+	From uint32 `yaml:"from,omitempty" json:"from,omitempty"`
+	To uint32 `yaml:"to,omitempty" json:"to,omitempty"`
+	Steps uint64 `yaml:"steps,omitempty" json:"steps,omitempty"`
+	Period string `yaml:"period,omitempty" json:"period,omitempty"`
+
+	//Values parsed from the fields above
+	offset time.Duration
+	size uint64
+	content partdisk.FileContent
+	duration uint64 //Seconds
+	profile cpuload.LoadProfile
+}
+
+//Timeline of steps
+type Scenario struct {
+	Name string `yaml:"name" json:"name"`
+	Steps []Step `yaml:"steps" json:"steps"`
+}
+
+//Parses a scenario in YAML or JSON, JSON being a subset of YAML, and checks its steps.  The steps are sorted by time
+func Parse(data []byte) (*Scenario, error) {
+	sc := &Scenario{}
+	if err := yaml.Unmarshal(data, sc); err != nil {
+		return nil, fmt.Errorf("invalid scenario: %s", err.Error())
+	}
+	if len(sc.Steps) == 0 {
+		return nil, fmt.Errorf("the scenario has no steps")
+	}
+	for index := range sc.Steps {
+		if err := sc.Steps[index].parse(); err != nil {
+			return nil, fmt.Errorf("step %d: %s", index+1, err.Error())
+		}
+	}
+	sort.SliceStable(sc.Steps, func(i, j int) bool { return sc.Steps[i].offset < sc.Steps[j].offset })
+	return sc, nil
+}
+
+//Checks the fields of the step and computes the parsed values
+func (st *Step) parse() error {
+	var err error
+	if st.At == "" {
+		return fmt.Errorf("no time specified, use at")
+	}
+	st.offset, err = units.ParseDuration(st.At)
+	if err != nil {
+		return err
+	}
+	switch st.Action {
+	case ActionMem, ActionDisk:
+		if st.Size == "" {
+			return fmt.Errorf("%s action requires a size", st.Action)
+		}
+		st.size, err = units.ParseSize(st.Size)
+		if err != nil {
+			return err
+		}
+		if st.Action == ActionMem {
+			if st.Fill == "" {
+				st.Fill = partmem.FillAscii
+			} else if !partmem.ValidFill(st.Fill) {
+				return fmt.Errorf("invalid fill mode: %s, valid modes are: zero, touch, random, ascii", st.Fill)
+			}
+			return nil
+		}
+		if st.Content == "" {
+			st.Content = partdisk.ContentAscii
+		}
+		st.content, err = partdisk.NewContent(st.Content, 0)
+		if err != nil {
+			return err
+		}
+		if st.Mode == "" {
+			st.Mode = partdisk.ModeWrite
+		} else if !partdisk.ValidMode(st.Mode) {
+			return fmt.Errorf("invalid file creation mode: %s, valid modes are: write, fallocate, sparse", st.Mode)
+		}
+	case ActionCpu:
+		if st.Duration == "" {
+			return fmt.Errorf("cpu action requires a duration")
+		}
+		st.duration, err = units.ParseSeconds(st.Duration)
+		if err != nil {
+			return err
+		}
+		if st.Profile == "" || st.Profile == "flat" {
+			if st.Percent == 0 {
+				st.Percent = 100
+			}
+			st.profile, err = cpuload.NewProfile("flat", st.Percent, 0, 0, 0)
+		} else {
+			var period time.Duration
+			if st.Period != "" {
+				period, err = units.ParseDuration(st.Period)
+				if err != nil {
+					return err
+				}
+			}
+			st.profile, err = cpuload.NewProfile(st.Profile, st.From, st.To, st.Steps, period)
+		}
+		if err != nil {
+			return err
+		}
+	case ActionCpuStop, ActionRelease:
+	default:
+		return fmt.Errorf("unknown action: %q, valid actions are: %s", st.Action, strings.Join([]string{ActionMem, ActionDisk, ActionCpu, ActionCpuStop, ActionRelease}, ", "))
+	}
+	return nil
+}
+
+//Short description of the step, like "mem size=512Mi fill=ascii"
+func (st Step) String() string {
+	switch st.Action {
+	case ActionMem:
+		return fmt.Sprintf("mem size=%s fill=%s", st.Size, st.Fill)
+	case ActionDisk:
+		return fmt.Sprintf("disk size=%s content=%s mode=%s", st.Size, st.content, st.Mode)
+	case ActionCpu:
+		workers := "default"
+		if st.Workers > 0 {
+			workers = fmt.Sprint(st.Workers)
+		}
+		return fmt.Sprintf("cpu duration=%s workers=%s load=%s", st.Duration, workers, st.profile)
+	}
+	return st.Action
+}
@@ -0,0 +1,79 @@
+package scenario
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	data := `
+name: soak
+steps:
+  - at: 2m
+    action: release
+  - at: 0
+    action: mem
+    size: 512Mi
+  - at: 30s
+    action: disk
+    size: 1G
+    mode: sparse
+  - at: 1m
+    action: cpu
+    duration: 5m
+    profile: sine
+    from: 20
+    to: 80
+    period: 1m
+`
+	sc, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatalf("Parse(): %v", err)
+	}
+	//The steps are sorted by time and the defaults are filled in
+	want := []struct {
+		offset time.Duration
+		description string
+	}{
+		{0, "mem size=512Mi fill=ascii"},
+		{30 * time.Second, "disk size=1G content=ascii mode=sparse"},
+		{time.Minute, "cpu duration=5m workers=default load=sine wave between 20% and 80% with period 1m0s"},
+		{2 * time.Minute, "release"},
+	}
+	if sc.Name != "soak" || len(sc.Steps) != len(want) {
+		t.Fatalf("Parse() = %s with %d steps, want soak with %d steps", sc.Name, len(sc.Steps), len(want))
+	}
+	for index, step := range sc.Steps {
+		if step.offset != want[index].offset || step.String() != want[index].description {
+			t.Errorf("step %d = %s at %s, want %s at %s", index+1, step, step.offset, want[index].description, want[index].offset)
+		}
+	}
+	if sc.Steps[0].size != 512<<20 || sc.Steps[2].duration != 300 {
+		t.Errorf("parsed values: size %d, duration %d, want %d and 300", sc.Steps[0].size, sc.Steps[2].duration, 512<<20)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		data, message string
+	}{
+		{`name: empty`, "no steps"},
+		{`steps: [{action: mem, size: 1Gi}]`, "no time specified"},
+		{`steps: [{at: 1x, action: mem, size: 1Gi}]`, "invalid duration"},
+		{`steps: [{at: 0, action: mem}]`, "requires a size"},
+		{`steps: [{at: 0, action: mem, size: 1Gi, fill: gold}]`, "invalid fill mode"},
+		{`steps: [{at: 0, action: disk, size: 1Gi, mode: copy}]`, "invalid file creation mode"},
+		{`steps: [{at: 0, action: cpu}]`, "requires a duration"},
+		{`steps: [{at: 0, action: cpu, duration: 500ms}]`, "at least 1 second"},
+		{`steps: [{at: 0, action: cpu, duration: 1m, profile: square}]`, "requires a period"},
+		{`steps: [{at: 0, action: net}]`, "unknown action"},
+		{`steps: {at: 0}`, "invalid scenario"},
+	}
+	for _, tt := range tests {
+		_, err := Parse([]byte(tt.data))
+		if err == nil || !strings.Contains(err.Error(), tt.message) {
+			t.Errorf("Parse(%q) = %v, want an error containing %q", tt.data, err, tt.message)
+		}
+	}
+}
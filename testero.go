@@ -1,24 +1,51 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
 	"errors"
+	"github.com/tale-toul/testero/auth"
+	"github.com/tale-toul/testero/cgroup"
 	"github.com/tale-toul/testero/cpuload"
+	"github.com/tale-toul/testero/ioload"
+	"github.com/tale-toul/testero/limits"
+	"github.com/tale-toul/testero/metrics"
+	"github.com/tale-toul/testero/netload"
 	"github.com/tale-toul/testero/partdisk"
 	"github.com/tale-toul/testero/partmem"
+	"github.com/tale-toul/testero/requests"
+	"github.com/tale-toul/testero/scenario"
+	"github.com/tale-toul/testero/ttl"
+	"github.com/tale-toul/testero/units"
+	"github.com/tale-toul/testero/webui"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"runtime/debug"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 )
 
-//Listening IP for the web server
-const ip string = "0.0.0.0"
-//Listening port for web server
-const port string = "8080"
+//Listening IP for the web server, can be changed with the LISTEN_ADDR env var
+var ip string = "0.0.0.0"
+//Listening port for web server, can be changed with the PORT env var
+var port string = "8080"
 
 //const defnum string = "49344058972249501099" //Requires more than 5 min, prime number
 //const defnum string = "1234567890723456781" //Shorter and faster number
@@ -31,6 +58,10 @@ var partScheme partmem.PartCollection
 var fileScheme partdisk.FileCollection
 //Data structure containing info about CPU load
 var cpuScheme cpuload.CpuCollection
+//Data structure containing info about I/O load
+var ioScheme ioload.IoCollection
+//Data structure containing info about network load
+var netScheme netload.NetCollection
 
 //Lock buffered, to make sure there is no concurrency problems with memory operations
 var lock chan int64
@@ -38,15 +69,56 @@ var lock chan int64
 var filelock chan int64
 //Lock buffered, to avoid cpu load concurrent requests
 var cpulock chan int64
+//Queues of memory and disk requests, run one at a time
+var memQueue *requests.Queue
+var fileQueue *requests.Queue
+//History of CPU load requests
+var cpuHistory = requests.NewHistory(requests.HistorySize)
+//Time to live of the memory and disk allocations, released automatically when it expires
+var memTTL *ttl.Timer
+var fileTTL *ttl.Timer
+//Time to live applied to memory and disk requests without a ttl parameter.  Set with the DEFAULT_TTL env var, 0 means no expiration
+var defaultTTL time.Duration
+//Runs the scenarios posted to /api/scenario or loaded from the SCENARIO_FILE env var
+var scenarioRunner = scenario.NewRunner(scenarioExecutor{})
+//Lock buffered, to avoid I/O load concurrent requests
+var iolock chan int64
+//Lock buffered, to avoid network load concurrent requests
+var netlock chan int64
 
-//Environment variable to set the limit for request to add data into memory.  In bytes
-var HIGHMEMLIM uint64
-//Environment var to set the limit of storage space, in bytes.
-var HIGHFILELIM uint64
+//Web server, stopped by gracefulShutdown.  The requests use shutdownCtx as base context, so streams like the network source stop with the application
+var server = &http.Server{BaseContext: func(net.Listener) context.Context { return shutdownCtx }}
+//Context of the memory, disk and CPU requests, cancelled when the application shuts down
+var shutdownCtx, stopAll = context.WithCancel(context.Background())
+//Time given to the requests in progress to finish when shutting down.  Set with the SHUTDOWN_GRACE env var
+var shutdownGrace = 10 * time.Second
+//Exit status of the application, sent by gracefulShutdown when the cleanup is done
+var shutdownDone = make(chan int, 1)
+
+//Actions applied at start up to the file trees left in DATADIR by previous runs
+const (
+	orphansDelete = "delete" //Remove the trees
+	orphansAdopt = "adopt" //Take over the files of the newest tree, remove the others
+	orphansIgnore = "ignore" //Leave the trees, they are only logged
+)
+//Action applied to the orphan trees.  Set with the CLEANUP_ORPHANS env var
+var orphanMode = orphansDelete
+//The action is also applied to the trees without marker, created by previous versions.  Set with the CLEANUP_LEGACY_TREES env var,
+//by default they are only logged
+var cleanupLegacy bool
+
+//Limit for request to add data into memory, in bytes.  Set with the HIGHMEMLIM env var, automatically or at runtime
+var memLimit *limits.Limit
+//Limit of storage space, in bytes.  Set with the HIGHFILELIM env var, automatically or at runtime
+var fileLimit *limits.Limit
 //Env var specifying the directory to store files
 var DATADIR string
 //Env var containing the number to factor to generate CPU load
 var NUMTOFACTOR string
+//Tokens accepted to access the API endpoints
+var authTokens *auth.TokenSet
+//Token sent to the target instance of the network loads.  Set with the TARGET_TOKEN env var, the token of the request is never forwarded
+var targetToken string
 
 //Get the value from env var with name evv and convert it to a unsigned integer 
 func setEnvNum(evv string) uint64 {
@@ -83,30 +155,66 @@ func main() {
 	//Initilize cpu lock
 	cpulock = make(chan int64, 1)
 	cpulock <- 0
+	//Initialize memory and disk request queues
+	memQueue = requests.NewQueue(shutdownCtx, "memory")
+	fileQueue = requests.NewQueue(shutdownCtx, "disk")
+	//Initialize the timers that release the memory and disk allocations
+	memTTL = ttl.New("memory", releaseMemTTL)
+	fileTTL = ttl.New("disk", releaseFilesTTL)
+	//Initialize I/O lock
+	iolock = make(chan int64, 1)
+	iolock <- 0
+	//Initialize network lock
+	netlock = make(chan int64, 1)
+	netlock <- 0
 
 	//Get values from environment variables, if they exist
-	HIGHMEMLIM = setEnvNum("HIGHMEMLIM")
-	HIGHFILELIM = setEnvNum("HIGHFILELIM")
 	DATADIR = os.Getenv("DATADIR")
 	if DATADIR == "" {
 		DATADIR = "."
 	}
 	log.Printf("DATADIR set to: %s",DATADIR)
-	//Set the high limit for memory the total size to request
-	if HIGHMEMLIM == 0 { //Not defined
-		HIGHMEMLIM = freeRam()
-	}
-	log.Printf("HIGHMEMLIM set to: %d bytes.",HIGHMEMLIM)
-	
-	//Set the high limit for the total file size requests
-	if HIGHFILELIM == 0 {
-		HIGHFILELIM, err = getfreeDisk(DATADIR)
+
+	//Default number of CPU load workers
+	if quota, source := cgroup.CpuQuota(); quota > 0 {
+		log.Printf("Default CPU load workers: %d, from cgroup CPU quota in %s.",cpuload.DefaultWorkers(),source)
+	} else {
+		log.Printf("Default CPU load workers: %d, from number of CPUs.",cpuload.DefaultWorkers())
+	}
+
+	//Set the default time to live of memory and disk allocations
+	if evttl := os.Getenv("DEFAULT_TTL"); evttl != "" {
+		defaultTTL, err = units.ParseDuration(evttl)
 		if err != nil {
-			fmt.Printf("Error computing available disk space for directory: %s\n%s\n", DATADIR, err.Error())
-			return
+			log.Printf("Error: Invalid DEFAULT_TTL environment var. %s.  Allocations will not expire by default", err.Error())
+			defaultTTL = 0
+		} else {
+			log.Printf("Default time to live of memory and disk allocations: %s", defaultTTL)
+		}
+	}
+
+	//Set the action applied to the trees left by previous runs
+	if evorphans := os.Getenv("CLEANUP_ORPHANS"); evorphans != "" {
+		switch evorphans {
+		case orphansDelete, orphansAdopt, orphansIgnore:
+			orphanMode = evorphans
+		default:
+			log.Printf("Error: Invalid CLEANUP_ORPHANS environment var. CLEANUP_ORPHANS=%s, valid values are: delete, adopt, ignore.  Default value will be used", evorphans)
+		}
+	}
+	cleanupLegacy = strings.ToLower(os.Getenv("CLEANUP_LEGACY_TREES")) == "true"
+	log.Printf("Orphan trees cleanup: %s, trees without marker included: %t", orphanMode, cleanupLegacy)
+
+	//Set the grace period for shutting down
+	if evgrace := os.Getenv("SHUTDOWN_GRACE"); evgrace != "" {
+		grace, errg := units.ParseDuration(evgrace)
+		if errg != nil {
+			log.Printf("Error: Invalid SHUTDOWN_GRACE environment var. %s.  Default value will be used", errg.Error())
+		} else {
+			shutdownGrace = grace
 		}
 	}
-	log.Printf("HIGHFILELIM set to: %d bytes.",HIGHFILELIM)
+	log.Printf("Shutdown grace period: %s", shutdownGrace)
 
 	//Set the number to factor, used to generate CPU load
 	NUMTOFACTOR = os.Getenv("NUMTOFACTOR")
@@ -114,37 +222,287 @@ func main() {
 		NUMTOFACTOR = defnum
 	}
 
+	//Set the address and port the web server listens on
+	if evip := os.Getenv("LISTEN_ADDR"); evip != "" {
+		ip = evip
+	}
+	if evport := os.Getenv("PORT"); evport != "" {
+		pnum, errp := strconv.ParseUint(evport, 10, 16)
+		if errp != nil || pnum == 0 {
+			log.Printf("Error: Invalid PORT environment var. PORT=%s.  Default value will be used", evport)
+		} else {
+			port = evport
+		}
+	}
+	//Get the TLS configuration, if any
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		log.Printf("Error setting up TLS: %s", err.Error())
+		return
+	}
+	//Get the authentication tokens, if any
+	authTokens, err = auth.Load(os.Getenv("AUTH_TOKENS"), os.Getenv("AUTH_TOKENS_FILE"))
+	if err != nil {
+		log.Printf("Error loading authentication tokens: %s", err.Error())
+		return
+	}
+	targetToken = os.Getenv("TARGET_TOKEN")
+	if authTokens.Enabled() {
+		log.Printf("Authentication enabled with %d read and %d mutate tokens", authTokens.Count(auth.Read), authTokens.Count(auth.Mutate))
+	} else {
+		log.Printf("Authentication disabled, no tokens defined")
+	}
+
 	//Create objects for memory, files and CPU load
 	partScheme = partmem.NewpC()
 	fileScheme.NewfC(DATADIR)
 	cpuScheme.NewCc(NUMTOFACTOR)
+	netScheme.NewNc()
 
-	err = createTree(fileScheme)
+	err = createTree(&fileScheme)
 	if err != nil {
 		log.Printf("CreateFiles(): Error creating directory tree: %s\n%s\n",fileScheme.GetRandStr(),err.Error())
 		return
 	}
+	err = fileScheme.WriteMarker()
+	if err != nil {
+		log.Printf("Error writing the marker of the directory tree: %s", err.Error())
+		deleteTree(&fileScheme)
+		return
+	}
+	//The trees left by runs that did not shut down gracefully are removed or taken over
+	cleanupOrphans()
+	//The I/O work file lives in the base dir of the files tree, so it is removed with it
+	ioScheme.NewIc(fileScheme.GetRandStr())
 
+	//Set the high limit for memory the total size to request, and for the total file size requests.
+	//If not defined by the environment they are computed again before every request
+	memLimit, err = limits.New("HIGHMEMLIM", setEnvNum("HIGHMEMLIM"), autoMemLimit)
+	if err != nil {
+		log.Printf("Error computing available memory: %s", err.Error())
+		deleteTree(&fileScheme)
+		return
+	}
+	fileLimit, err = limits.New("HIGHFILELIM", setEnvNum("HIGHFILELIM"), autoFileLimit)
+	if err != nil {
+		log.Printf("Error computing available disk space for directory: %s\n%s\n", DATADIR, err.Error())
+		deleteTree(&fileScheme)
+		return
+	}
+
+	//Limits handlers
+	handle("/api/limits", auth.Read, getLimits)
+	handle("/api/limits/set", auth.Mutate, setLimits)
 	//Memory handlers
-	http.HandleFunc("/api/mem/set", addMem)
-	http.HandleFunc("/api/mem/getdef", getDefMem)
-	http.HandleFunc("/api/mem/getact", getActMem)
+	handle("/api/mem/set", auth.Mutate, addMem)
+	handle("/api/mem/getdef", auth.Read, getDefMem)
+	handle("/api/mem/getact", auth.Read, getActMem)
+	handle("/api/mem/status", auth.Read, getMemStatus)
+	handle("/api/mem/release", auth.Mutate, releaseMem)
+	handle("/api/mem/ttl", auth.Mutate, extendTTL(memTTL))
+	handle("/api/mem/cancel", auth.Mutate, cancelRequest("/api/mem", memQueue))
+	handle("/api/mem/requests", auth.Read, listRequests("/api/mem/requests", memQueue.List, memQueue.Get))
+	handle("/api/mem/requests/", auth.Read, listRequests("/api/mem/requests", memQueue.List, memQueue.Get))
 	//Disk handlers
-	http.HandleFunc("/api/disk/set", addFiles)
-	http.HandleFunc("/api/disk/getdef", getDefFiles)
-	http.HandleFunc("/api/disk/getact",getActFiles)
+	handle("/api/disk/set", auth.Mutate, addFiles)
+	handle("/api/disk/getdef", auth.Read, getDefFiles)
+	handle("/api/disk/getact", auth.Read, getActFiles)
+	handle("/api/disk/status", auth.Read, getFileStatus)
+	handle("/api/disk/release", auth.Mutate, releaseFiles)
+	handle("/api/disk/ttl", auth.Mutate, extendTTL(fileTTL))
+	handle("/api/disk/cancel", auth.Mutate, cancelRequest("/api/disk", fileQueue))
+	handle("/api/disk/requests", auth.Read, listRequests("/api/disk/requests", fileQueue.List, fileQueue.Get))
+	handle("/api/disk/requests/", auth.Read, listRequests("/api/disk/requests", fileQueue.List, fileQueue.Get))
 	//CPU handlers
-	http.HandleFunc("/api/cpu/load", addLoad)
-	http.HandleFunc("/api/cpu/stop", stopLoad)
-	http.HandleFunc("/api/cpu/getact", loadReqInfo)
+	handle("/api/cpu/load", auth.Mutate, addLoad)
+	handle("/api/cpu/stop", auth.Mutate, stopLoad)
+	handle("/api/cpu/getact", auth.Read, loadReqInfo)
+	handle("/api/cpu/requests", auth.Read, listRequests("/api/cpu/requests", cpuHistory.List, cpuHistory.Get))
+	handle("/api/cpu/requests/", auth.Read, listRequests("/api/cpu/requests", cpuHistory.List, cpuHistory.Get))
+	//I/O handlers
+	handle("/api/io/load", auth.Mutate, addIoLoad)
+	handle("/api/io/stop", auth.Mutate, stopIoLoad)
+	handle("/api/io/getact", auth.Read, ioReqInfo)
+	//Network handlers
+	handle("/api/net/sink", auth.Mutate, netSink)
+	handle("/api/net/source", auth.Mutate, netSource)
+	handle("/api/net/load", auth.Mutate, addNetLoad)
+	handle("/api/net/stop", auth.Mutate, stopNetLoad)
+	handle("/api/net/getact", auth.Read, netReqInfo)
+	//Scenario handlers
+	handle("/api/scenario", auth.Mutate, startScenario)
+	handle("/api/scenario/status", auth.Read, getScenarioStatus)
+	handle("/api/scenario/pause", auth.Mutate, changeScenario("paused", scenarioRunner.Pause))
+	handle("/api/scenario/resume", auth.Mutate, changeScenario("resumed", scenarioRunner.Resume))
+	handle("/api/scenario/abort", auth.Mutate, changeScenario("aborted", scenarioRunner.Abort))
+	//Summary and web interface
+	handle("/api/summary", auth.Read, getSummary)
+	handle("/ui/", auth.None, http.StripPrefix("/ui/", webui.Handler()).ServeHTTP)
+	//Metrics
+	handle("/metrics", auth.Read, getMetrics)
+
+	//Start the scenario file, if any
+	if scfile := os.Getenv("SCENARIO_FILE"); scfile != "" {
+		err = loadScenario(scfile)
+		if err != nil {
+			log.Printf("Error loading scenario file %s: %s", scfile, err.Error())
+			deleteTree(&fileScheme)
+			return
+		}
+	}
 
 	//Start web server
-	lisock := fmt.Sprintf("%s:%s",ip,port)
-	log.Printf("Starting web server on: %s",lisock)
-	log.Fatal(http.ListenAndServe(lisock, nil))
+	lisock := net.JoinHostPort(ip, port)
+	server.Addr = lisock
+	if tlsConfig != nil {
+		server.TLSConfig = tlsConfig
+		log.Printf("Starting web server with TLS on: %s",lisock)
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		log.Printf("Starting web server on: %s",lisock)
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed { //Wait for gracefulShutdown to release everything
+		os.Exit(<-shutdownDone)
+	}
+	log.Printf("Error running web server: %s", err.Error())
 	//Delete all files before exiting
-	log.Printf("Deleting all files at %s",fileScheme.GetRandStr())
-	deleteTree((&fileScheme))
+	deleteTree(&fileScheme)
+	os.Exit(1)
+}
+
+//Counter of requests per handler and outcome, exported in /metrics
+var requestCounter = metrics.NewRequestCounter()
+
+//ResponseWriter that records the outcome of the request for the metrics
+type outcomeWriter struct {
+	http.ResponseWriter
+	outcome string
+}
+
+//Sends any buffered data to the client, needed to stream data
+func (ow *outcomeWriter) Flush() {
+	if flusher, ok := ow.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//Registers the handler for the path, requiring a token with the scope and counting its requests by outcome
+func handle(path string, scope auth.Scope, handler http.HandlerFunc) {
+	http.HandleFunc(path, func(writer http.ResponseWriter, request *http.Request) {
+		ow := &outcomeWriter{ResponseWriter: writer, outcome: "ok"}
+		switch authTokens.Check(request, scope) {
+		case auth.Unauthorized:
+			ow.Header().Set("WWW-Authenticate", `Bearer realm="testero"`)
+			deny(ow, request, errUnauthorized, "Missing or invalid token\n")
+		case auth.Forbidden:
+			deny(ow, request, errForbidden, fmt.Sprintf("Token does not grant %s access to this endpoint\n", scope))
+		default:
+			handler(ow, request)
+		}
+		requestCounter.Inc(path, ow.outcome)
+	})
+}
+
+//Rejects a request that failed authentication or authorization.  Unlike other errors the HTTP status is also sent with plain text responses
+func deny(writer http.ResponseWriter, request *http.Request, code string, text string) {
+	log.Printf("Access denied to %s from %s: %s", request.URL.Path, request.RemoteAddr, code)
+	time.Sleep(1 * time.Second)
+	if !wantsJSON(request) {
+		writer.WriteHeader(errStatus[code])
+	}
+	replyError(writer, request, code, text)
+}
+
+//Error codes returned in JSON responses
+const (
+	errBusy = "server_busy"
+	errPending = "pending_request"
+	errOverLimit = "over_limit"
+	errInvalid = "invalid_parameter"
+	errNoRequest = "no_request"
+	errMismatch = "id_mismatch"
+	errInternal = "internal_error"
+	errUnauthorized = "unauthorized"
+	errForbidden = "forbidden"
+)
+
+//HTTP status codes sent with JSON error responses
+var errStatus = map[string]int{
+	errBusy: http.StatusServiceUnavailable,
+	errPending: http.StatusConflict,
+	errOverLimit: http.StatusUnprocessableEntity,
+	errInvalid: http.StatusBadRequest,
+	errNoRequest: http.StatusNotFound,
+	errMismatch: http.StatusConflict,
+	errInternal: http.StatusInternalServerError,
+	errUnauthorized: http.StatusUnauthorized,
+	errForbidden: http.StatusForbidden,
+}
+
+//Report about memory parts or files, with the limit in use
+type limitReport struct {
+	Report interface{} `json:"report"`
+	Limit uint64 `json:"limit"`
+	LimitSource string `json:"limit_source"`
+}
+
+//Creates a report with the current value and source of the limit
+func newLimitReport(report interface{}, lm *limits.Limit) limitReport {
+	value, source := lm.Get()
+	return limitReport{report, value, source}
+}
+
+//Report about the memory parts or files created, with the limit and the time to live of the allocation
+type actReport struct {
+	limitReport
+	TTL ttl.Status `json:"ttl"`
+}
+
+//Progress of the current or last memory request, with the number of requests queued
+type progReport struct {
+	partmem.Progress
+	Queued int `json:"queued"`
+}
+
+//Check if the client asked for a JSON response, with the format=json parameter or the Accept header
+func wantsJSON(request *http.Request) bool {
+	if request.URL.Query().Get("format") == "json" {
+		return true
+	}
+	return strings.Contains(request.Header.Get("Accept"), "application/json")
+}
+
+//Send the response as JSON if the client asked for it, or as plain text otherwise
+func reply(writer http.ResponseWriter, request *http.Request, text string, obj interface{}) {
+	if !wantsJSON(request) {
+		fmt.Fprint(writer, text)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(writer).Encode(obj)
+	if err != nil {
+		log.Printf("reply(): Error encoding JSON response: %s", err.Error())
+	}
+}
+
+//Send an error response.  As JSON it includes a machine readable code and the matching HTTP status,
+//as plain text the status is 200 like any other response
+func replyError(writer http.ResponseWriter, request *http.Request, code string, text string) {
+	if ow, ok := writer.(*outcomeWriter); ok {
+		ow.outcome = code
+	}
+	if !wantsJSON(request) {
+		fmt.Fprint(writer, text)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(errStatus[code])
+	body := map[string]interface{}{"error": map[string]string{"code": code, "message": strings.TrimSpace(text)}}
+	err := json.NewEncoder(writer).Encode(body)
+	if err != nil {
+		log.Printf("replyError(): Error encoding JSON response: %s", err.Error())
+	}
 }
 
 //Free the concurrency memory lock. It's a function so it can be deferred
@@ -163,51 +521,248 @@ func getLock(l chan int64) (int64, bool) {
 	}
 }
 
-//Compute and create the parts for the ammount of memory requested
+//Queue the request to compute and create the parts for the ammount of memory requested
 func addMem(writer http.ResponseWriter, request *http.Request) {
 	tstamp := time.Now().UnixNano() //Request timestamp
-	lval, islav := getLock(lock)
-	if !islav { //Lock not available
+	bsm := getSizeParam(request)
+	var sm units.Size //Requested size, absolute or relative to the current one
+	var err error
+	if bsm != "" {
+		sm, err = units.ParseRelativeSize(bsm)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Could not get size: %s\n", err.Error()))
+			return
+		}
+	} else { //No size specified
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errInvalid, "File size (in bytes) not specified: set?size=<number of bytes>\n")
 		return
-	} else if lval != 0 { //There is a pending request for mem allocation
-		defer freeLock(lock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+	}
+	fill := request.URL.Query().Get("fill")
+	if fill == "" {
+		fill = partmem.FillAscii
+	} else if !partmem.ValidFill(fill) {
 		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, fmt.Sprintf("Invalid fill mode: %s, valid modes are: zero, touch, random, ascii\n", fill))
 		return
-	} else { //Lock is available and no pending requests (0)
-		defer freeLock(lock, &tstamp) //Make sure the lock is released even if errors occur
-		bsm := request.URL.Query().Get("size")
-		var sm uint64 //Requested size in bytes
-		var err error
-		if bsm != "" {
-			sm, err = strconv.ParseUint(bsm, 10, 64)
-			if err != nil {
-				time.Sleep(1 * time.Second)
-				fmt.Fprintf(writer, "Could not get size: %s\n", err.Error())
-				tstamp = 0
-				return
-			}
-		} else { //No size specified
+	}
+	policy, err := getPolicy(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	lifetime, err := getTTL(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	if hilimit, _ := memLimit.Update(); overLimit(sm, partScheme.HeldSize(), hilimit) {
+		le := partmem.LimitError{Requested: sm.Bytes, Limit: hilimit}
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errOverLimit, fmt.Sprintf("Could not compute memory parts: %s\n", le.Error()))
+		return
+	}
+	rec, err := submitMem(tstamp, sm, fill, lifetime, policy)
+	if err != nil {
+		replyError(writer, request, errBusy, fmt.Sprintf("Request rejected, %s\n", err.Error()))
+		return
+	}
+	reply(writer, request, fmt.Sprintf("Memory data request sent for %s, fill mode %s, %s, with id#: %d, %s, check /api/mem/status?id=%d or /api/mem/getact\n", sizeState(sm), fill, ttlState(lifetime), tstamp, queueState(rec), tstamp),
+		map[string]interface{}{"request_id": tstamp, "size": sm.Bytes, "size_human": sm.Human(), "operation": sm.Operation, "fill": fill, "ttl_seconds": lifetime.Seconds(), "state": rec.State, "position": rec.Position})
+}
+
+//Checks an absolute size against the limit before the request is queued, the same way DefineParts and DefineFiles do:
+//growing over the limit is refused, shrinking is always allowed.  Relative sizes are checked when the request runs
+func overLimit(sm units.Size, held uint64, hilimit uint64) bool {
+	return sm.Operation == units.Set && sm.Bytes > held && sm.Bytes > hilimit
+}
+
+//Adds a memory request to the queue.  The allocation is released after lifetime, 0 means it does not expire
+func submitMem(tstamp int64, sm units.Size, fill string, lifetime time.Duration, policy string) (requests.Record, error) {
+	return memQueue.Submit(tstamp, fmt.Sprintf("size=%s fill=%s%s", sm, fill, ttlParam(lifetime)), policy, func(ctx context.Context) error {
+		return runMem(ctx, tstamp, sm, fill, lifetime)
+	})
+}
+
+//Compute and create the parts for a queued memory request.  Waits for the lock, so it runs when no other memory request is using it.
+//Cancelling ctx stops the creation of parts
+func runMem(ctx context.Context, tstamp int64, size units.Size, fill string, lifetime time.Duration) error {
+	lval := <-lock
+	if lval != 0 { //Should not happen, the queue runs one request at a time
+		lock <- lval
+		return fmt.Errorf("the lock contains another request: %d", lval)
+	}
+	//Relative sizes are applied to the memory held when the request runs, after the requests queued before it
+	sm, err := size.Apply(partScheme.SizeOfParts())
+	if err != nil {
+		lock <- 0
+		return err
+	}
+	if size.Operation != units.Set {
+		log.Printf("runMem(): Request %d changes the memory size by %s to %d bytes", tstamp, size.Human(), sm)
+	}
+	//Compute the number of parts of each size to accomodate the total size.
+	//The result is stored in partScheme
+	hilimit, _ := memLimit.Update()
+	err = partmem.DefineParts(sm, hilimit, &partScheme)
+	if err != nil {
+		lock <- 0
+		err = fmt.Errorf("Could not compute memory parts: %w", err)
+		var le *partmem.LimitError
+		if errors.As(err, &le) {
+			return requests.WithCode(errOverLimit, err)
+		}
+		return err
+	}
+	//Hand over the lock to create the actual parts
+	lock <- tstamp
+	err = partmem.CreateParts(ctx, &partScheme, tstamp, fill, lock)
+	if err == nil {
+		memTTL.Set(allocationID(tstamp, sm), lifetime)
+	}
+	return err
+}
+
+//Gets the size parameter from the raw query.  A + in a query stands for a space, but in a size it is the sign of a relative size
+//that was not encoded as %2B, so it is kept as a +
+func getSizeParam(request *http.Request) string {
+	for _, param := range strings.Split(request.URL.RawQuery, "&") {
+		name, value := param, ""
+		if i := strings.Index(param, "="); i >= 0 {
+			name, value = param[:i], param[i+1:]
+		}
+		if name != "size" {
+			continue
+		}
+		size, err := url.QueryUnescape(strings.ReplaceAll(value, "+", "%2B"))
+		if err != nil {
+			return value
+		}
+		return size
+	}
+	return ""
+}
+
+//Gets the queueing policy from the request parameters, by default the request is queued
+func getPolicy(request *http.Request) (string, error) {
+	policy := request.URL.Query().Get("policy")
+	if policy == "" {
+		return requests.PolicyQueue, nil
+	}
+	if !requests.ValidPolicy(policy) {
+		return "", fmt.Errorf("Invalid policy: %s, valid policies are: queue, replace, reject", policy)
+	}
+	return policy, nil
+}
+
+//Describes the state of a request just queued
+func queueState(rec requests.Record) string {
+	if rec.Position > 0 {
+		return fmt.Sprintf("queued at position %d", rec.Position)
+	}
+	return rec.State
+}
+
+//Gets the time to live of the allocation from the request parameters, DEFAULT_TTL if not specified
+func getTTL(request *http.Request) (time.Duration, error) {
+	bttl := request.URL.Query().Get("ttl")
+	if bttl == "" {
+		return defaultTTL, nil
+	}
+	lifetime, err := units.ParseDuration(bttl)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid ttl: %s", err.Error())
+	}
+	return lifetime, nil
+}
+
+//Describes the size of a request in bytes and in human readable form
+func sizeState(sm units.Size) string {
+	if sm.Operation == units.Set {
+		return fmt.Sprintf("%s bytes (%s)", sm, sm.Human())
+	}
+	return fmt.Sprintf("%s bytes (%s) relative to the current size", sm, sm.Human())
+}
+
+//Describes the time to live of a request
+func ttlState(lifetime time.Duration) string {
+	if lifetime == 0 {
+		return "no time to live"
+	}
+	return fmt.Sprintf("time to live %s", lifetime)
+}
+
+//Parameter added to the description of a request in the history
+func ttlParam(lifetime time.Duration) string {
+	if lifetime == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" ttl=%s", lifetime)
+}
+
+//ID of the allocation made by a request, 0 if the request released everything
+func allocationID(tstamp int64, sm uint64) int64 {
+	if sm == 0 {
+		return 0
+	}
+	return tstamp
+}
+
+//Queues the release of the memory when its time to live expires.  Returns false if other requests are queued, they replace the allocation anyway
+func releaseMemTTL(id int64) bool {
+	_, err := submitMem(time.Now().UnixNano(), units.Size{Operation: units.Set}, partmem.FillAscii, 0, requests.PolicyReject)
+	return err == nil
+}
+
+//Queues the release of the files when their time to live expires.  Returns false if other requests are queued, they replace the allocation anyway
+func releaseFilesTTL(id int64) bool {
+	content, _ := partdisk.NewContent(partdisk.ContentAscii, 0)
+	_, err := submitFiles(time.Now().UnixNano(), units.Size{Operation: units.Set}, content, partdisk.ModeWrite, 0, requests.PolicyReject)
+	return err == nil
+}
+
+//Queues the release of all the memory before its time to live expires
+func releaseMem(writer http.ResponseWriter, request *http.Request) {
+	tstamp := time.Now().UnixNano() //Request timestamp
+	policy, err := getPolicy(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	rec, err := submitMem(tstamp, units.Size{Operation: units.Set}, partmem.FillAscii, 0, policy)
+	if err != nil {
+		replyError(writer, request, errBusy, fmt.Sprintf("Request rejected, %s\n", err.Error()))
+		return
+	}
+	reply(writer, request, fmt.Sprintf("Memory release request sent with id#: %d, %s, check /api/mem/status?id=%d or /api/mem/getact\n", tstamp, queueState(rec), tstamp),
+		map[string]interface{}{"request_id": tstamp, "size": 0, "state": rec.State, "position": rec.Position})
+}
+
+//Returns a handler that changes the time to live of the current allocation, counting from now
+func extendTTL(timer *ttl.Timer) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		bttl := request.URL.Query().Get("ttl")
+		if bttl == "" {
 			time.Sleep(1 * time.Second)
-			fmt.Fprintf(writer, "File size (in bytes) not specified: set?size=<number of bytes>\n")
-			tstamp = 0
+			replyError(writer, request, errInvalid, "No time to live specified: ttl=<duration>, 0 removes the expiration\n")
 			return
 		}
-
-		//Compute the number of parts of each size to accomodate the total size.
-		//The result is stored in partScheme
-		err = partmem.DefineParts(sm, HIGHMEMLIM, &partScheme)
+		lifetime, err := units.ParseDuration(bttl)
 		if err != nil {
 			time.Sleep(1 * time.Second)
-			fmt.Fprintf(writer, "Could not compute memory parts: %s\n", err.Error())
-			tstamp = 0
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ttl: %s\n", err.Error()))
+			return
+		}
+		status, err := timer.Extend(lifetime)
+		if err != nil {
+			replyError(writer, request, errNoRequest, fmt.Sprintf("Time to live not changed, %s\n", err.Error()))
 			return
 		}
-		//Create the actual parts
-		go partmem.CreateParts(&partScheme, tstamp, lock)
-		fmt.Fprintf(writer, "Memory data request sent for %d bytes, with id#: %d, check /api/mem/getact\n", sm, tstamp)
+		reply(writer, request, fmt.Sprintf("Request ID: %d\n%s", status.RequestID, status), status)
 	}
 }
 
@@ -216,18 +771,24 @@ func getDefMem(writer http.ResponseWriter, request *http.Request) {
 	lval, islav := getLock(lock)
 	if !islav { //Lock not available
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
 		return
 	} else if lval != 0 { //There is a pending request for mem allocation
 		defer freeLock(lock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
 		time.Sleep(1 * time.Second)
 		return
 	} else { //Lock obtained and no pending request
 		var unlock int64 = 0
 		defer freeLock(lock, &unlock) //Make sure the lock is released even if error occur
-		mensj := partmem.GetDefParts(&partScheme)
-		fmt.Fprintf(writer, mensj)
+		memLimit.Update()
+		if wantsJSON(request) {
+			reply(writer, request, "", newLimitReport(partmem.DefParts(&partScheme), memLimit))
+		} else {
+			mensj := partmem.GetDefParts(&partScheme)
+			mensj += fmt.Sprintf("Limit: %s\n", memLimit)
+			fmt.Fprint(writer, mensj)
+		}
 	}
 }
 
@@ -236,65 +797,224 @@ func getActMem(writer http.ResponseWriter, request *http.Request) {
 	lval, islav := getLock(lock)
 	if !islav { //Lock not available
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
 		return
 	} else if lval != 0 { //There is a pending request for mem allocation
 		defer freeLock(lock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
 		time.Sleep(1 * time.Second)
 		return
 	} else { //Lock obtained and no pending request
 		var unlock int64 = 0
 		defer freeLock(lock, &unlock) //Make sure the lock is released even if error occur
 		dump := request.URL.Query().Get("dump")
-		mensj := partScheme.GetActParts(dump)
-		fmt.Fprintf(writer, mensj)
+		if wantsJSON(request) {
+			reply(writer, request, "", actReport{newLimitReport(partScheme.ActParts(dump), memLimit), memTTL.Status()})
+		} else {
+			mensj := partScheme.GetActParts(dump)
+			mensj += memTTL.Status().String()
+			fmt.Fprint(writer, mensj)
+		}
 	}
 }
 
-// Returns the number of bytes of free RAM memory available in the system
-func freeRam() uint64 {
-	var localInfo syscall.Sysinfo_t
-	err := syscall.Sysinfo(&localInfo)
+//Reports the progress of the current memory request.  Does not use the lock so it can be called while parts are being created
+func getMemStatus(writer http.ResponseWriter, request *http.Request) {
+	var id int64
+	var err error
+	cid := request.URL.Query().Get("id")
+	if cid != "" {
+		id, err = strconv.ParseInt(cid, 10, 64)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+			return
+		}
+	}
+	//Requests that are queued, or that failed before creating any part, have no progress information
+	if rec, ok := memQueue.Get(id); ok && id != partScheme.GetProgressID() {
+		reply(writer, request, rec.String(), rec)
+		return
+	}
+	var mensj string
+	queued, _ := memQueue.Length()
+	if queued > 0 {
+		mensj = fmt.Sprintf("Requests queued: %d\n", queued)
+	}
+	prog, err := partScheme.GetProgress(id)
 	if err != nil {
-		log.Fatal(err)
+		replyError(writer, request, errNoRequest, err.Error()+"\n"+mensj)
+		return
 	}
-	return localInfo.Freeram
+	reply(writer, request, prog.String()+mensj, progReport{prog, queued})
 }
 
-//Get the ammount of free space in the device associated with the directory
-func getfreeDisk(dir string) (uint64, error) {
-	var fstats syscall.Statfs_t
-	err := syscall.Statfs(dir, &fstats)
-	if err != nil {
-		return 0, err
+//Creates a handler that cancels the memory or disk request with the id parameter.  A queued request is removed from the queue,
+//a running request stops and keeps the parts or files created so far.  prefix is the path of the subsystem endpoints
+func cancelRequest(prefix string, queue *requests.Queue) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		cid := request.URL.Query().Get("id")
+		if cid == "" {
+			replyError(writer, request, errInvalid, "Missing id parameter\n")
+			return
+		}
+		id, err := strconv.ParseInt(cid, 10, 64)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+			return
+		}
+		rec, err := queue.Cancel(id)
+		switch err {
+		case nil:
+		case requests.ErrUnknown:
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errNoRequest, fmt.Sprintf("Unknown request ID: %d\n", id))
+			return
+		default:
+			replyError(writer, request, errMismatch, fmt.Sprintf("Request %d cannot be cancelled, %s, state: %s\n", id, err.Error(), rec.State))
+			return
+		}
+		var mensj string
+		if rec.State == requests.Running {
+			mensj = fmt.Sprintf("Request %d is being cancelled, check %s/status?id=%d for the data kept\n", id, prefix, id)
+		} else {
+			mensj = fmt.Sprintf("Request %d cancelled while queued\n", id)
+		}
+		reply(writer, request, mensj, map[string]interface{}{"request_id": id, "state": rec.State})
 	}
-	return fstats.Bavail * uint64(fstats.Bsize), nil
 }
 
-//Create a single directory
-func createDir(dirname string) error {
-	err := os.Mkdir(dirname,0755)
-	if err != nil {
-		if errors.Is(err, os.ErrExist) {
-			fin, errin := os.Stat(dirname)
-			if errin == nil && fin.IsDir() { //Directory already exists, that's fine
-				return nil
-			} else {//Error creating directory
-				log.Printf("createDir(): Out error: %s; In error: %s", err,errin)
-				return err
+//Creates a handler that lists the requests of a subsystem, newest first, or shows a single request if the path is prefix/<id>
+func listRequests(prefix string, list func() []requests.Record, get func(int64) (requests.Record, bool)) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		cid := strings.Trim(strings.TrimPrefix(request.URL.Path, prefix), "/")
+		if cid == "" {
+			recs := list()
+			mensj := fmt.Sprintf("Requests: %d\n", len(recs))
+			for _, rec := range recs {
+				mensj += rec.Line()
 			}
-		} else { //Error creating directory
-			return err
+			reply(writer, request, mensj, recs)
+			return
+		}
+		id, err := strconv.ParseInt(cid, 10, 64)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+			return
+		}
+		rec, ok := get(id)
+		if !ok {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errNoRequest, fmt.Sprintf("Unknown request ID: %d\n", id))
+			return
 		}
+		reply(writer, request, rec.String(), rec)
 	}
-	return nil
 }
 
-//Creates the directory tree to store files
-func createTree(fc partdisk.FileCollection) error {
-	log.Printf("Creating base dir: %s",fc.GetRandStr())
-	err := createDir(fc.GetRandStr())
+//Reports the state of a disk request.  Does not use the lock so it can be called while files are being created
+func getFileStatus(writer http.ResponseWriter, request *http.Request) {
+	cid := request.URL.Query().Get("id")
+	if cid == "" {
+		queued, running := fileQueue.Length()
+		reply(writer, request, fmt.Sprintf("Request running: %t\nRequests queued: %d\n", running, queued),
+			map[string]interface{}{"running": running, "queued": queued})
+		return
+	}
+	id, err := strconv.ParseInt(cid, 10, 64)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+		return
+	}
+	rec, ok := fileQueue.Get(id)
+	if !ok {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errNoRequest, fmt.Sprintf("Unknown request ID: %d\n", id))
+		return
+	}
+	reply(writer, request, rec.String(), rec)
+}
+
+//Get the default memory limit and a description of where it comes from: the memory available in the container's cgroup
+//if it has a limit, otherwise the free memory in the system.  If the usage of the cgroup reached its limit nothing is available
+func defaultMemLimit() (uint64, string) {
+	if limit, source := cgroup.MemoryLimit(); limit > 0 {
+		available, _ := cgroup.MemoryAvailable()
+		if available == 0 {
+			log.Printf("defaultMemLimit(): The memory usage of the cgroup is %d bytes, at or over its limit of %d bytes in %s, no memory is available", cgroup.MemoryUsage(), limit, source)
+		}
+		return available, fmt.Sprintf("cgroup %s limit in %s minus usage", cgroup.Version(), source)
+	}
+	return freeRam(), "free system memory"
+}
+
+//Computes the automatic memory limit: the memory available plus the memory already held by the parts,
+//because the limit applies to the total size requested
+func autoMemLimit() (uint64, string, error) {
+	available, source := defaultMemLimit()
+	return available + partScheme.HeldSize(), source + " plus memory held", nil
+}
+
+//Computes the automatic disk limit: the free space in DATADIR plus the space already allocated to the files
+func autoFileLimit() (uint64, string, error) {
+	free, err := getfreeDisk(DATADIR)
+	if err != nil {
+		return 0, "", err
+	}
+	rep, err := fileScheme.ActFiles()
+	if err != nil {
+		return 0, "", err
+	}
+	_, ioalloc := fileScheme.IoFileSize()
+	return free + rep.TotalAllocated + ioalloc, fmt.Sprintf("free space in %s plus space allocated to files", DATADIR), nil
+}
+
+// Returns the number of bytes of free RAM memory available in the system
+func freeRam() uint64 {
+	var localInfo syscall.Sysinfo_t
+	err := syscall.Sysinfo(&localInfo)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return localInfo.Freeram
+}
+
+//Get the ammount of free space in the device associated with the directory
+func getfreeDisk(dir string) (uint64, error) {
+	var fstats syscall.Statfs_t
+	err := syscall.Statfs(dir, &fstats)
+	if err != nil {
+		return 0, err
+	}
+	return fstats.Bavail * uint64(fstats.Bsize), nil
+}
+
+//Create a single directory
+func createDir(dirname string) error {
+	err := os.Mkdir(dirname,0755)
+	if err != nil {
+		if errors.Is(err, os.ErrExist) {
+			fin, errin := os.Stat(dirname)
+			if errin == nil && fin.IsDir() { //Directory already exists, that's fine
+				return nil
+			} else {//Error creating directory
+				log.Printf("createDir(): Out error: %s; In error: %s", err,errin)
+				return err
+			}
+		} else { //Error creating directory
+			return err
+		}
+	}
+	return nil
+}
+
+//Creates the directory tree to store files
+func createTree(fc *partdisk.FileCollection) error {
+	log.Printf("Creating base dir: %s",fc.GetRandStr())
+	err := createDir(fc.GetRandStr())
 	if err != nil {
 		log.Printf("Error creating basedir: %s", fc.GetRandStr())
 		return err
@@ -312,6 +1032,48 @@ func createTree(fc partdisk.FileCollection) error {
 	return nil
 }
 
+//Looks for the trees left in DATADIR by previous runs, killed before they could delete them, and applies orphanMode to them.
+//In adopt mode the newest tree replaces the current one, which is still empty, and the others are removed.
+//Trees without marker are only logged, unless cleanupLegacy is set
+func cleanupOrphans() {
+	orphans, err := fileScheme.FindOrphans(DATADIR)
+	if err != nil {
+		log.Printf("cleanupOrphans(): Error looking for orphan trees in %s: %s", DATADIR, err.Error())
+		return
+	}
+	adopted := false
+	for _, orphan := range orphans {
+		desc := fmt.Sprintf("%s, %d bytes (%s)", orphan.Path, orphan.Size, units.FormatSize(orphan.Size))
+		if orphan.Marker == nil {
+			desc += ", created by a version without marker"
+		} else if orphan.Marker.PID != 0 {
+			desc += fmt.Sprintf(", created by pid %d on %s at %s", orphan.Marker.PID, orphan.Marker.Host, orphan.Marker.Started.Format(time.RFC3339))
+		}
+		switch {
+		case orphanMode == orphansIgnore:
+			log.Printf("Orphan tree ignored: %s", desc)
+		case orphan.Marker == nil && !cleanupLegacy:
+			log.Printf("Orphan tree ignored: %s, set CLEANUP_LEGACY_TREES=true to %s it", desc, orphanMode)
+		case orphanMode == orphansAdopt && !adopted:
+			nfiles, nbytes, err := fileScheme.Adopt(orphan)
+			if err != nil {
+				log.Printf("cleanupOrphans(): Error adopting tree %s: %s", orphan.Path, err.Error())
+				continue
+			}
+			adopted = true
+			log.Printf("Orphan tree adopted: %s, keeping %d files with %d bytes", desc, nfiles, nbytes)
+			fileTTL.Set(allocationID(time.Now().UnixNano(), nbytes), defaultTTL)
+		default:
+			err = partdisk.RemoveOrphan(orphan)
+			if err != nil {
+				log.Printf("cleanupOrphans(): Error deleting tree %s: %s", orphan.Path, err.Error())
+				continue
+			}
+			log.Printf("Orphan tree deleted: %s", desc)
+		}
+	}
+}
+
 //Removes the directory tree and all its contents.  This function is to be called as part of program graceful shutdown.
 func deleteTree(fc *partdisk.FileCollection) error {
 	log.Printf("Deleting directory tree: %s", fc.GetRandStr())
@@ -324,52 +1086,164 @@ func deleteTree(fc *partdisk.FileCollection) error {
 	return nil
 }
 
-//Request the definition of files
+//Queue the request to compute and create the files for the ammount of storage requested
 func addFiles(writer http.ResponseWriter, request *http.Request) {
 	tstamp := time.Now().UnixNano() //Request timestamp
-	lval, islav := getLock(filelock)
-	if !islav { //Lock not available
+	bsm := getSizeParam(request)
+	var sm units.Size //Requested size, absolute or relative to the current one
+	var err error
+	if bsm != "" {
+		sm, err = units.ParseRelativeSize(bsm)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Could not get size: %s\n", err.Error()))
+			return
+		}
+	} else { //No size specified
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errInvalid, "No data size specified\n")
 		return
-	} else if lval != 0 { //There is a pending request for file creation
-		defer freeLock(filelock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+	}
+	content, err := getFileContent(request)
+	if err != nil {
 		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, fmt.Sprintf("Invalid file content: %s\n", err.Error()))
 		return
-	} else { //Lock is available and no pending requests (0)
-		defer freeLock(filelock, &tstamp) //Make sure the lock is released even if errors happen
-		bsm := request.URL.Query().Get("size")
-		var sm uint64 //Requested size in bytes
-		var err error
-		if bsm != "" {
-			sm, err = strconv.ParseUint(bsm, 10, 64)
-			if err != nil {
-				time.Sleep(1 * time.Second)
-				fmt.Fprintf(writer, "Could not get size: %s\n", err.Error())
-				tstamp = 0
-				return
-			}
-		} else { //No size specified
-			time.Sleep(1 * time.Second)
-			fmt.Fprintf(writer, "No data size specified\n")
-			tstamp = 0
-			return
+	}
+	mode := request.URL.Query().Get("mode")
+	if mode == "" {
+		mode = partdisk.ModeWrite
+	} else if !partdisk.ValidMode(mode) {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, fmt.Sprintf("Invalid file creation mode: %s, valid modes are: write, fallocate, sparse\n", mode))
+		return
+	}
+	policy, err := getPolicy(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	lifetime, err := getTTL(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	held, _ := fileScheme.TotalFileSize()
+	if hilimit := fileSpace(); overLimit(sm, held, hilimit) {
+		le := partdisk.LimitError{Requested: sm.Bytes, Limit: hilimit}
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errOverLimit, fmt.Sprintf("Could not compute file distribution: %s\n", le.Error()))
+		return
+	}
+	rec, err := submitFiles(tstamp, sm, content, mode, lifetime, policy)
+	if err != nil {
+		replyError(writer, request, errBusy, fmt.Sprintf("Request rejected, %s\n", err.Error()))
+		return
+	}
+	reply(writer, request, fmt.Sprintf("File data request sent for %s, content %s, mode %s, %s, with id#: %d, %s, check /api/disk/status?id=%d or /api/disk/getact\n", sizeState(sm), content, mode, ttlState(lifetime), tstamp, queueState(rec), tstamp),
+		map[string]interface{}{"request_id": tstamp, "size": sm.Bytes, "size_human": sm.Human(), "operation": sm.Operation, "content": content.String(), "mode": mode, "ttl_seconds": lifetime.Seconds(), "state": rec.State, "position": rec.Position})
+}
+
+//Queues the release of all the files before their time to live expires
+func releaseFiles(writer http.ResponseWriter, request *http.Request) {
+	tstamp := time.Now().UnixNano() //Request timestamp
+	policy, err := getPolicy(request)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, err.Error()+"\n")
+		return
+	}
+	content, _ := partdisk.NewContent(partdisk.ContentAscii, 0)
+	rec, err := submitFiles(tstamp, units.Size{Operation: units.Set}, content, partdisk.ModeWrite, 0, policy)
+	if err != nil {
+		replyError(writer, request, errBusy, fmt.Sprintf("Request rejected, %s\n", err.Error()))
+		return
+	}
+	reply(writer, request, fmt.Sprintf("File release request sent with id#: %d, %s, check /api/disk/status?id=%d or /api/disk/getact\n", tstamp, queueState(rec), tstamp),
+		map[string]interface{}{"request_id": tstamp, "size": 0, "state": rec.State, "position": rec.Position})
+}
+
+//Returns the part of the disk limit available to the files, the I/O work file uses the rest
+func fileSpace() uint64 {
+	hilimit, _ := fileLimit.Update()
+	iosize, _ := fileScheme.IoFileSize()
+	if iosize > hilimit {
+		return 0
+	}
+	return hilimit - iosize
+}
+
+//Adds a disk request to the queue.  The allocation is released after lifetime, 0 means it does not expire
+func submitFiles(tstamp int64, sm units.Size, content partdisk.FileContent, mode string, lifetime time.Duration, policy string) (requests.Record, error) {
+	return fileQueue.Submit(tstamp, fmt.Sprintf("size=%s content=%s mode=%s%s", sm, content, mode, ttlParam(lifetime)), policy, func(ctx context.Context) error {
+		return runFiles(ctx, tstamp, sm, content, mode, lifetime)
+	})
+}
+
+//Compute and create the files for a queued disk request.  Waits for the lock, so it runs when no other disk request is using it.
+//Cancelling ctx stops the creation of files
+func runFiles(ctx context.Context, tstamp int64, size units.Size, content partdisk.FileContent, mode string, lifetime time.Duration) error {
+	lval := <-filelock
+	if lval != 0 { //Should not happen, the queue runs one request at a time
+		filelock <- lval
+		return fmt.Errorf("the lock contains another request: %d", lval)
+	}
+	//Relative sizes are applied to the files present when the request runs, after the requests queued before it
+	var sm uint64
+	current, err := fileScheme.TotalFileSize()
+	if err == nil {
+		sm, err = size.Apply(current)
+	}
+	if err != nil {
+		filelock <- 0
+		return err
+	}
+	if size.Operation != units.Set {
+		log.Printf("runFiles(): Request %d changes the file size by %s to %d bytes", tstamp, size.Human(), sm)
+	}
+	//Compute the number of files of each size to accomodate the total size.
+	//The result is stored in fileScheme
+	hilimit := fileSpace()
+	err = partdisk.DefineFiles(sm, hilimit, &fileScheme)
+	if err != nil {
+		filelock <- 0
+		err = fmt.Errorf("Could not compute file distribution: %w", err)
+		var le *partdisk.LimitError
+		if errors.As(err, &le) {
+			return requests.WithCode(errOverLimit, err)
 		}
+		return err
+	}
+	//Hand over the lock to create the actual files
+	filelock <- tstamp
+	err = partdisk.CreateFiles(ctx, &fileScheme, tstamp, content, mode, filelock)
+	if err == nil {
+		fileTTL.Set(allocationID(tstamp, sm), lifetime)
+	}
+	return err
+}
 
-		//Compute the number of parts of each size to accomodate the total size.
-		//The result is stored in partScheme
-		err = partdisk.DefineFiles(sm, HIGHFILELIM, &fileScheme)
+//Gets the content type of new files from the request parameters.  Defaults to ascii, or random if a compression ratio is specified
+func getFileContent(request *http.Request) (partdisk.FileContent, error) {
+	var ratio uint64
+	var err error
+	kind := request.URL.Query().Get("content")
+	bratio := request.URL.Query().Get("ratio")
+	if bratio != "" {
+		ratio, err = strconv.ParseUint(bratio, 10, 32)
 		if err != nil {
-			time.Sleep(1 * time.Second)
-			fmt.Fprintf(writer, "Could not compute file distribution: %s\n", err.Error())
-			tstamp = 0
-			return
+			return partdisk.FileContent{}, fmt.Errorf("ratio=%s: %s", bratio, err.Error())
+		}
+		if kind == "" {
+			kind = partdisk.ContentRandom
 		}
-		//Create the actual parts under here
-		go partdisk.CreateFiles(&fileScheme, tstamp, filelock)
-		fmt.Fprintf(writer, "File data request sent for %d bytes, with id#: %d, check /api/disk/getact\n", sm, tstamp)
 	}
+	if kind == "" {
+		kind = partdisk.ContentAscii
+	}
+	return partdisk.NewContent(kind, ratio)
 }
 
 //Shows the definition of files and sizes
@@ -377,18 +1251,24 @@ func getDefFiles(writer http.ResponseWriter, request *http.Request) {
 	lval, islav := getLock(filelock)
 	if !islav { //Lock not available
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
 		return
 	} else if lval != 0 { //There is a pending request for file allocation
 		defer freeLock(filelock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
 		time.Sleep(1 * time.Second)
 		return
 	} else { //Lock obtained and no pending request
 		var unlock int64 = 0
 		defer freeLock(filelock, &unlock) //Make sure the lock is released even if error occur
-		mensj := partdisk.GetDefFiles(&fileScheme)
-		fmt.Fprintf(writer, mensj)
+		fileLimit.Update()
+		if wantsJSON(request) {
+			reply(writer, request, "", newLimitReport(partdisk.DefFiles(&fileScheme), fileLimit))
+		} else {
+			mensj := partdisk.GetDefFiles(&fileScheme)
+			mensj += fmt.Sprintf("Limit: %s\n", fileLimit)
+			fmt.Fprint(writer, mensj)
+		}
 	}
 }
 
@@ -397,31 +1277,110 @@ func getActFiles(writer http.ResponseWriter, request *http.Request) {
 	lval, islav := getLock(filelock)
 	if !islav { //Lock not available
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
 		return
 	} else if lval != 0 { //There is a pending request for mem allocation
 		defer freeLock(filelock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
 		time.Sleep(1 * time.Second)
 		return
 	} else { //Lock obtained and no pending request
 		var unlock int64 = 0
 		defer freeLock(filelock, &unlock) //Make sure the lock is released even if error occur
-		mensj := fileScheme.GetActFiles()
-		fmt.Fprintf(writer, mensj)
+		if wantsJSON(request) {
+			rep, err := fileScheme.ActFiles()
+			if err != nil {
+				replyError(writer, request, errInternal, "Error getting files information\n")
+				return
+			}
+			reply(writer, request, "", actReport{newLimitReport(rep, fileLimit), fileTTL.Status()})
+		} else {
+			mensj := fileScheme.GetActFiles()
+			mensj += fileTTL.Status().String()
+			fmt.Fprint(writer, mensj)
+		}
 	}
 }
 
-//Takes care of cleaning up when the application is terminated by a TERM or INT signal
+//Takes care of cleaning up when the application is terminated by a TERM or INT signal.
+//Stops the web server, cancels the requests in progress and releases the memory, files and loads before exiting
 func gracefulShutdown(sigchan chan os.Signal) {
 	wait := <- sigchan
-	log.Printf("Signal received: %v",wait)
-	err := deleteTree(&fileScheme)
+	log.Printf("Signal received: %v, shutting down with a grace period of %s",wait,shutdownGrace)
+	deadline := time.Now().Add(shutdownGrace)
+	//No more work is accepted, cancel the work in progress.  This comes first so the requests stop while the web server waits for them
+	scenarioRunner.Abort()
+	memQueue.Close()
+	fileQueue.Close()
+	stopAll()
+	ioScheme.Halt()
+	netScheme.Halt()
+	//Stop accepting connections and wait for the API requests in progress during half the grace period, the rest is
+	//left to release the memory and files.  Connections still open after that, like a network sink, are closed
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace/2)
+	defer cancel()
+	err := server.Shutdown(ctx)
 	if err != nil {
-		log.Printf("Error shuting down: %s",err.Error())
-		os.Exit(1)
+		log.Printf("gracefulShutdown(): Web server did not stop cleanly: %s, closing the connections", err.Error())
+		server.Close()
+	}
+	status := 0
+	//Memory parts are freed once the running request, if any, hands back the lock
+	if holdLock(lock, deadline) {
+		nparts, nbytes := partScheme.Release()
+		debug.FreeOSMemory()
+		log.Printf("Memory released: %d bytes in %d parts", nbytes, nparts)
 	} else {
-		os.Exit(0)
+		log.Printf("gracefulShutdown(): Timeout waiting for the memory request to stop, memory not released")
+		status = 1
+	}
+	//The files are removed once the running request, if any, hands back the lock.  If it is still writing them the tree
+	//is left in place, it will be found as an orphan on the next start up
+	if holdLock(filelock, deadline) {
+		fsize, _ := fileScheme.TotalFileSize()
+		iosize, _ := fileScheme.IoFileSize()
+		fsize += iosize
+		err = deleteTree(&fileScheme)
+		if err != nil {
+			log.Printf("Error shuting down: %s",err.Error())
+			status = 1
+		} else {
+			log.Printf("Files removed: %d bytes", fsize)
+		}
+	} else {
+		log.Printf("gracefulShutdown(): Timeout waiting for the disk request to stop, files not removed from %s", fileScheme.GetRandStr())
+		status = 1
+	}
+	//The loads are stopped when their locks are free
+	names := []string{"CPU", "I/O", "Network"}
+	for i, l := range []chan int64{cpulock, iolock, netlock} {
+		if holdLock(l, deadline) {
+			log.Printf("%s load stopped", names[i])
+		} else {
+			log.Printf("gracefulShutdown(): Timeout waiting for the %s load to stop", names[i])
+			status = 1
+		}
+	}
+	log.Printf("Shutdown complete")
+	shutdownDone <- status
+}
+
+//Waits for the lock to be free and keeps it, so no other request can use it.  Returns false if the deadline passes first
+func holdLock(l chan int64, deadline time.Time) bool {
+	for {
+		select {
+		case lval := <-l:
+			if lval == 0 {
+				return true
+			}
+			l <- lval
+		case <-time.After(time.Until(deadline)):
+			return false
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
 }
 
@@ -431,11 +1390,11 @@ func addLoad(writer http.ResponseWriter, request *http.Request) {
 	lval, islav := getLock(cpulock)
 	if !islav { //Lock not available
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer, "Server busy, try again later\n")
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
 		return
 	} else if lval != 0 { //There is a pending request for cpu load
 		defer freeLock(cpulock, &lval)
-		fmt.Fprintf(writer, "Server contains pending request, try again later\n")
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
 		time.Sleep(1 * time.Second)
 		return
 	} else { //Lock is available and no pending requests (0)
@@ -444,22 +1403,83 @@ func addLoad(writer http.ResponseWriter, request *http.Request) {
 		var sm uint64 //Requested time in seconds
 		var err error
 		if bsm != "" {
-			sm, err = strconv.ParseUint(bsm, 10, 64)
+			sm, err = units.ParseSeconds(bsm)
 			if err != nil {
-				fmt.Fprintf(writer, "Invalid time specification: %s\n", err.Error())
+				replyError(writer, request, errInvalid, fmt.Sprintf("Invalid time specification: %s\n", err.Error()))
 				tstamp = 0
 				return
 			}
 		} else { //No time specified
-			fmt.Fprintf(writer, "No load time specified\n")
+			replyError(writer, request, errInvalid, "No load time specified\n")
+			tstamp = 0
+			return
+		}
+		bwk := request.URL.Query().Get("workers")
+		nwk := cpuload.DefaultWorkers() //Number of factoring workers
+		if bwk != "" {
+			wk, err := strconv.ParseUint(bwk, 10, 16)
+			if err != nil || wk == 0 {
+				replyError(writer, request, errInvalid, fmt.Sprintf("Invalid workers specification: %s\n", bwk))
+				tstamp = 0
+				return
+			}
+			nwk = int(wk)
+		}
+		profile, err := getLoadProfile(request)
+		if err != nil {
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid load profile: %s\n", err.Error()))
 			tstamp = 0
 			return
 		}
-		go cpuload.LoadUp(&cpuScheme, tstamp, sm, cpulock)
-		fmt.Fprintf(writer,"CPU load requested for %d seconds with id: %d\n",sm,tstamp)
+		startLoad(tstamp, sm, nwk, profile)
+		human := (time.Duration(sm) * time.Second).String()
+		reply(writer, request, fmt.Sprintf("CPU load requested for %d seconds (%s), %s, with %d workers and id: %d\n",sm,human,profile,nwk,tstamp),
+			map[string]interface{}{"request_id": tstamp, "time": sm, "time_human": human, "profile": profile.String(), "workers": nwk})
 	}
 }	
 
+//Records the CPU load request and starts it in the background.  The load begins when the lock is handed over with the value tstamp
+func startLoad(tstamp int64, sm uint64, nwk int, profile cpuload.LoadProfile) {
+	cpuHistory.Add(tstamp, fmt.Sprintf("time=%d workers=%d load=%s", sm, nwk, profile), requests.Running)
+	cpuHistory.Start(tstamp)
+	go func() {
+		cpuHistory.Finish(tstamp, cpuload.LoadUp(shutdownCtx, &cpuScheme, tstamp, sm, nwk, profile, cpulock))
+	}()
+}
+
+//Builds the CPU load profile from the request parameters.  Without a profile parameter the load is flat at percent (100 by default)
+func getLoadProfile(request *http.Request) (cpuload.LoadProfile, error) {
+	query := request.URL.Query()
+	//Numeric parameters and their default values
+	params := map[string]uint64{"percent": 100, "from": 0, "to": 100, "steps": 0}
+	for name := range params {
+		bval := query.Get(name)
+		if bval != "" {
+			val, err := strconv.ParseUint(bval, 10, 32)
+			if err != nil {
+				return cpuload.LoadProfile{}, fmt.Errorf("%s=%s: %s", name, bval, err.Error())
+			}
+			params[name] = val
+		}
+	}
+	var period time.Duration
+	if bval := query.Get("period"); bval != "" {
+		var err error
+		period, err = units.ParseDuration(bval)
+		if err != nil {
+			return cpuload.LoadProfile{}, fmt.Errorf("period=%s: %s", bval, err.Error())
+		}
+	}
+	kind := query.Get("profile")
+	if kind == "" || kind == "flat" {
+		if params["percent"] == 0 {
+			return cpuload.LoadProfile{}, fmt.Errorf("percent must be between 1 and 100")
+		}
+		return cpuload.NewProfile("flat", uint32(params["percent"]), 0, 0, 0)
+	}
+	return cpuload.NewProfile(kind, uint32(params["from"]), uint32(params["to"]), params["steps"], period)
+}
+
 //Stops the CPU load if there is a request being run and the ID matches
 func stopLoad(writer http.ResponseWriter, request *http.Request) {
 	var id int64
@@ -472,19 +1492,23 @@ func stopLoad(writer http.ResponseWriter, request *http.Request) {
 			id, err = strconv.ParseInt(cid, 10, 64)
 			if err != nil {
 				time.Sleep(1 * time.Second)
-				fmt.Fprintf(writer, "Invalid ID specification: %s\n", err.Error())
+				replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
 				return
 			}
 		} else { //No ID specified
 			time.Sleep(1 * time.Second)
-			fmt.Fprintf(writer, "No request ID specified\n")
+			replyError(writer, request, errInvalid, "No request ID specified\n")
 			return
 		}
-		mensj := cpuload.StopLoad(cpuScheme, id)
-		fmt.Fprintf(writer, mensj)
+		mensj := cpuload.StopLoad(&cpuScheme, id)
+		if id != cpuScheme.GetID() {
+			replyError(writer, request, errMismatch, mensj)
+		} else {
+			reply(writer, request, mensj, map[string]interface{}{"request_id": id, "stopped": true})
+		}
 	} else { //Lock available, nothing to do
 		defer freeLock(cpulock,&lval)
-		fmt.Fprintf(writer, "No load request being processed, nothing to do\n")
+		replyError(writer, request, errNoRequest, "No load request being processed, nothing to do\n")
 		time.Sleep(1 * time.Second)
 		return
 	}
@@ -500,12 +1524,677 @@ func loadReqInfo(writer http.ResponseWriter, request *http.Request) {
 		loadt := fmt.Sprintf("Load time requested: %d seconds",duration)
 		end := start.Add(time.Second * time.Duration(duration))
 		loadend := fmt.Sprintf("Load request ends at: %v", end)
+		workers := fmt.Sprintf("Active workers: %d of %d", cpuScheme.GetActiveWorkers(), cpuScheme.GetWorkers())
+		profile := fmt.Sprintf("Load profile: %s, at second %d of %d", cpuScheme.GetProfile(), int64(time.Since(start).Seconds()), duration)
+		target := cpuScheme.GetPercent()
+		loadpct := fmt.Sprintf("Target load: %d%% per worker (%d%% total), achieved: %.1f%%", target, target*uint32(cpuScheme.GetWorkers()), cpuScheme.GetAchievedLoad())
 		time.Sleep(1 * time.Second)
-		fmt.Fprintf(writer,"%s\n%s\n%s\nNumber to factor: %s\n",reqt,loadt,loadend,NUMTOFACTOR)
+		reply(writer, request, fmt.Sprintf("%s\n%s\n%s\n%s\n%s\n%s\nNumber to factor: %s\n",reqt,loadt,loadend,workers,profile,loadpct,NUMTOFACTOR),
+			map[string]interface{}{
+				"request_id": cpuScheme.GetID(),
+				"start": start,
+				"time": duration,
+				"end": end,
+				"workers": cpuScheme.GetWorkers(),
+				"active_workers": cpuScheme.GetActiveWorkers(),
+				"profile": cpuScheme.GetProfile().String(),
+				"target_percent": target,
+				"achieved_percent": cpuScheme.GetAchievedLoad(),
+				"number_to_factor": NUMTOFACTOR,
+			})
 	} else { //Lock available, nothing to do
 		defer freeLock(cpulock,&lval)
-		fmt.Fprintf(writer,"No load request in progress\n")
+		replyError(writer, request, errNoRequest, "No load request in progress\n")
+		time.Sleep(1 * time.Second)
+		return
+	}
+}
+
+//Add I/O load on a work file under the DATADIR tree during the specified time
+func addIoLoad(writer http.ResponseWriter, request *http.Request) {
+	tstamp := time.Now().UnixNano() //Request timestamp
+	lval, islav := getLock(iolock)
+	if !islav { //Lock not available
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
+		return
+	} else if lval != 0 { //There is a pending request for I/O load
+		defer freeLock(iolock, &lval)
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
+		time.Sleep(1 * time.Second)
+		return
+	} else { //Lock is available and no pending requests (0)
+		defer freeLock(iolock, &tstamp) //Make sure the lock is released even if errors happen
+		iop, err := getIoParams(request)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid I/O load request: %s\n", err.Error()))
+			tstamp = 0
+			return
+		}
+		//The work file shares the disk limit with the files of the disk requests
+		used, _ := fileScheme.TotalFileSize()
+		if hilimit, _ := fileLimit.Update(); used+iop.FileSize > hilimit {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errOverLimit, fmt.Sprintf("Work file size is over the limit: requested %d bytes, used by files: %d bytes, limit: %d bytes.\n", iop.FileSize, used, hilimit))
+			tstamp = 0
+			return
+		}
+		go ioload.LoadUp(&ioScheme, tstamp, iop, iolock)
+		reply(writer, request, fmt.Sprintf("I/O load requested for %d seconds, mode %s, block size %d, iodepth %d, with id: %d\n", iop.Duration, iop.Mode, iop.BlockSize, iop.IoDepth, tstamp),
+			map[string]interface{}{"request_id": tstamp, "time": iop.Duration, "mode": iop.Mode, "block_size": iop.BlockSize, "iodepth": iop.IoDepth,
+				"rate": iop.Rate, "size": iop.FileSize, "direct": iop.Direct, "fsync": iop.Fsync})
+	}
+}
+
+//Builds the I/O load parameters from the request
+func getIoParams(request *http.Request) (ioload.IoParams, error) {
+	var err error
+	query := request.URL.Query()
+	//Default values
+	iop := ioload.IoParams{Mode: query.Get("mode"), BlockSize: 4096, IoDepth: 1, FileSize: 268435456}
+	if query.Get("time") == "" {
+		return iop, fmt.Errorf("No load time specified")
+	}
+	iop.Duration, err = units.ParseSeconds(query.Get("time"))
+	if err != nil {
+		return iop, fmt.Errorf("Invalid time specification: %s", err.Error())
+	}
+	if query.Get("bs") != "" {
+		iop.BlockSize, err = ioload.ParseBlockSize(query.Get("bs"))
+		if err != nil {
+			return iop, fmt.Errorf("Invalid block size specification: %s", err.Error())
+		}
+	}
+	if query.Get("iodepth") != "" {
+		depth, err := strconv.ParseUint(query.Get("iodepth"), 10, 16)
+		if err != nil {
+			return iop, fmt.Errorf("Invalid iodepth specification: %s", err.Error())
+		}
+		iop.IoDepth = int(depth)
+	}
+	//The rate is given in IOPS, or in MB/s with a MB suffix
+	if rate := query.Get("rate"); rate != "" {
+		mbps := strings.HasSuffix(strings.ToUpper(rate), "MB")
+		if mbps {
+			rate = rate[:len(rate)-2]
+		}
+		iop.Rate, err = strconv.ParseUint(rate, 10, 64)
+		if err != nil {
+			return iop, fmt.Errorf("Invalid rate specification: %s", err.Error())
+		}
+		if mbps && iop.BlockSize > 0 {
+			iop.Rate = iop.Rate * 1048576 / iop.BlockSize
+			if iop.Rate == 0 {
+				iop.Rate = 1
+			}
+		}
+	}
+	if query.Get("size") != "" {
+		iop.FileSize, err = units.ParseSize(query.Get("size"))
+		if err != nil {
+			return iop, fmt.Errorf("Invalid work file size specification: %s", err.Error())
+		}
+	}
+	iop.Direct = query.Get("direct") == "true"
+	iop.Fsync = query.Get("fsync") == "true"
+	return iop, iop.Validate()
+}
+
+//Stops the I/O load if there is a request being run and the ID matches
+func stopIoLoad(writer http.ResponseWriter, request *http.Request) {
+	lval, islav := getLock(iolock)
+	if !islav { //Lock not available, there is a load request being served
+		cid := request.URL.Query().Get("id")
+		if cid == "" {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, "No request ID specified\n")
+			return
+		}
+		id, err := strconv.ParseInt(cid, 10, 64)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+			return
+		}
+		mensj, stopped := ioload.StopLoad(&ioScheme, id)
+		if !stopped {
+			replyError(writer, request, errMismatch, mensj)
+		} else {
+			reply(writer, request, mensj, map[string]interface{}{"request_id": id, "stopped": true})
+		}
+	} else { //Lock available, nothing to do
+		defer freeLock(iolock, &lval)
+		replyError(writer, request, errNoRequest, "No I/O load request being processed, nothing to do\n")
 		time.Sleep(1 * time.Second)
+	}
+}
+
+//Gets information about the current I/O load request, or the last one if none is in progress
+func ioReqInfo(writer http.ResponseWriter, request *http.Request) {
+	rep, ok := ioScheme.GetActLoad()
+	if !ok {
+		replyError(writer, request, errNoRequest, "No I/O load request has been processed yet\n")
+		return
+	}
+	reply(writer, request, rep.String(), rep)
+}
+
+//Converts a rate in Mbit/s, possibly with decimals, into bits per second.  The data is paced in bytes, so a rate over 0
+//must be at least 8 bits per second, a lower one would be taken as no limit
+func parseMbps(rate string) (uint64, error) {
+	mbps, err := strconv.ParseFloat(rate, 64)
+	if err != nil {
+		return 0, err
+	}
+	if mbps < 0 {
+		return 0, fmt.Errorf("negative rate: %s", rate)
+	}
+	bits := uint64(math.Round(mbps * 1000000))
+	if mbps > 0 && bits < 8 {
+		return 0, fmt.Errorf("rate too low: %s, the minimum is 0.000008 Mbit/s", rate)
+	}
+	return bits, nil
+}
+
+//Discards the data uploaded by the client.  Used as the target of network load from another instance
+func netSink(writer http.ResponseWriter, request *http.Request) {
+	received, elapsed, err := netload.Sink(&netScheme, request)
+	if err != nil {
+		replyError(writer, request, errInternal, err.Error()+"\n")
 		return
 	}
+	reply(writer, request, fmt.Sprintf("Received %d bytes in %d seconds\n", received, int64(elapsed.Seconds())),
+		map[string]interface{}{"bytes": received, "elapsed_seconds": elapsed.Seconds()})
+}
+
+//Streams generated data to the client at the requested rate.  Used as the target of network load from another instance
+func netSource(writer http.ResponseWriter, request *http.Request) {
+	var rate, duration, size uint64
+	var err error
+	query := request.URL.Query()
+	if query.Get("rate") != "" {
+		rate, err = parseMbps(query.Get("rate"))
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid rate specification: %s\n", err.Error()))
+			return
+		}
+	}
+	if query.Get("time") != "" {
+		duration, err = units.ParseSeconds(query.Get("time"))
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid time specification: %s\n", err.Error()))
+			return
+		}
+	}
+	if query.Get("size") != "" {
+		size, err = units.ParseSize(query.Get("size"))
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid size specification: %s\n", err.Error()))
+			return
+		}
+	}
+	netload.Source(&netScheme, writer, request, rate, duration, size)
+}
+
+//Generate network traffic against another testero instance during the specified time
+func addNetLoad(writer http.ResponseWriter, request *http.Request) {
+	tstamp := time.Now().UnixNano() //Request timestamp
+	lval, islav := getLock(netlock)
+	if !islav { //Lock not available
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errBusy, "Server busy, try again later\n")
+		return
+	} else if lval != 0 { //There is a pending request for network load
+		defer freeLock(netlock, &lval)
+		replyError(writer, request, errPending, "Server contains pending request, try again later\n")
+		time.Sleep(1 * time.Second)
+		return
+	} else { //Lock is available and no pending requests (0)
+		defer freeLock(netlock, &tstamp) //Make sure the lock is released even if errors happen
+		np, err := getNetParams(request)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid network load request: %s\n", err.Error()))
+			tstamp = 0
+			return
+		}
+		go netload.LoadUp(&netScheme, tstamp, np, netlock)
+		reply(writer, request, fmt.Sprintf("Network %s load requested to %s for %d seconds with %d streams and id: %d\n", np.Direction, np.Target, np.Duration, np.Streams, tstamp),
+			map[string]interface{}{"request_id": tstamp, "time": np.Duration, "target": np.Target, "direction": np.Direction, "rate": np.Rate, "streams": np.Streams})
+	}
+}
+
+//Builds the network load parameters from the request
+func getNetParams(request *http.Request) (netload.NetParams, error) {
+	var err error
+	query := request.URL.Query()
+	//Default values
+	//The target instance is accessed with the TARGET_TOKEN token, the token of the request is not forwarded
+	np := netload.NetParams{Target: query.Get("target"), Direction: query.Get("direction"), Streams: 1, Token: targetToken}
+	if np.Direction == "" {
+		np.Direction = netload.Upload
+	}
+	if query.Get("time") == "" {
+		return np, fmt.Errorf("No load time specified")
+	}
+	np.Duration, err = units.ParseSeconds(query.Get("time"))
+	if err != nil {
+		return np, fmt.Errorf("Invalid time specification: %s", err.Error())
+	}
+	if query.Get("rate") != "" {
+		np.Rate, err = parseMbps(query.Get("rate"))
+		if err != nil {
+			return np, fmt.Errorf("Invalid rate specification: %s", err.Error())
+		}
+	}
+	if query.Get("streams") != "" {
+		streams, err := strconv.ParseUint(query.Get("streams"), 10, 16)
+		if err != nil {
+			return np, fmt.Errorf("Invalid streams specification: %s", err.Error())
+		}
+		np.Streams = int(streams)
+	}
+	return np, np.Validate()
+}
+
+//Stops the network load if there is a request being run and the ID matches
+func stopNetLoad(writer http.ResponseWriter, request *http.Request) {
+	lval, islav := getLock(netlock)
+	if !islav { //Lock not available, there is a load request being served
+		cid := request.URL.Query().Get("id")
+		if cid == "" {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, "No request ID specified\n")
+			return
+		}
+		id, err := strconv.ParseInt(cid, 10, 64)
+		if err != nil {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid ID specification: %s\n", err.Error()))
+			return
+		}
+		mensj, stopped := netload.StopLoad(&netScheme, id)
+		if !stopped {
+			replyError(writer, request, errMismatch, mensj)
+		} else {
+			reply(writer, request, mensj, map[string]interface{}{"request_id": id, "stopped": true})
+		}
+	} else { //Lock available, nothing to do
+		defer freeLock(netlock, &lval)
+		replyError(writer, request, errNoRequest, "No network load request being processed, nothing to do\n")
+		time.Sleep(1 * time.Second)
+	}
+}
+
+//Gets information about the current network load request, or the last one, and the data served by sink and source
+func netReqInfo(writer http.ResponseWriter, request *http.Request) {
+	rep := netScheme.GetActLoad()
+	reply(writer, request, rep.String(), rep)
+}
+
+//Shows the effective memory and disk limits and where they come from.  Automatic limits are shown as computed in the last request
+func getLimits(writer http.ResponseWriter, request *http.Request) {
+	mensj := fmt.Sprintf("Memory limit (HIGHMEMLIM): %s\nDisk limit (HIGHFILELIM): %s\n", memLimit, fileLimit)
+	reply(writer, request, mensj, map[string]limits.Report{"mem": memLimit.Report(), "disk": fileLimit.Report()})
+}
+
+//Overrides the memory and disk limits at runtime with the parameters mem and disk, in bytes.
+//The value reset removes the override and goes back to the environment or automatic value
+func setLimits(writer http.ResponseWriter, request *http.Request) {
+	query := request.URL.Query()
+	if query.Get("mem") == "" && query.Get("disk") == "" {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, "No limit specified, use the mem or disk parameters\n")
+		return
+	}
+	//Validate all the values before changing any limit
+	values := make(map[string]uint64)
+	for _, name := range []string{"mem", "disk"} {
+		bval := query.Get(name)
+		if bval == "" || bval == "reset" {
+			continue
+		}
+		value, err := units.ParseSize(bval)
+		if err != nil || value == 0 {
+			time.Sleep(1 * time.Second)
+			replyError(writer, request, errInvalid, fmt.Sprintf("Invalid %s limit: %s, must be a number of bytes greater than 0 or reset\n", name, bval))
+			return
+		}
+		values[name] = value
+	}
+	for name, lm := range map[string]*limits.Limit{"mem": memLimit, "disk": fileLimit} {
+		switch query.Get(name) {
+		case "":
+		case "reset":
+			if err := lm.Reset(); err != nil {
+				replyError(writer, request, errInternal, fmt.Sprintf("Error computing %s limit: %s\n", name, err.Error()))
+				return
+			}
+		default:
+			lm.Set(values[name])
+		}
+	}
+	getLimits(writer, request)
+}
+
+//Reports the state of all the consumers at once.  Does not use the locks so it answers while requests are running
+func getSummary(writer http.ResponseWriter, request *http.Request) {
+	//Memory
+	sizes, counts := partScheme.HeldParts()
+	var parts []partmem.PartCount
+	for index, size := range sizes {
+		parts = append(parts, partmem.PartCount{Size: size, Count: counts[index], TotalSize: size * counts[index]})
+	}
+	memHeld := partScheme.HeldSize()
+	memMax, _ := memLimit.Get()
+	memQueued, memRunning := memQueue.Length()
+	mensj := fmt.Sprintf("Memory: %d bytes (%s) of %d bytes, request running: %t, queued: %d\n", memHeld, units.FormatSize(memHeld), memMax, memRunning, memQueued)
+	//Disk
+	frep, err := fileScheme.ActFiles()
+	if err != nil {
+		replyError(writer, request, errInternal, "Error getting files information\n")
+		return
+	}
+	fileMax, _ := fileLimit.Get()
+	fileQueued, fileRunning := fileQueue.Length()
+	iosize, _ := fileScheme.IoFileSize()
+	mensj += fmt.Sprintf("Disk: %d bytes (%s) of %d bytes, I/O work file: %d bytes, request running: %t, queued: %d\n", frep.TotalSize, units.FormatSize(frep.TotalSize), fileMax, iosize, fileRunning, fileQueued)
+	//CPU
+	active := cpuScheme.GetActiveWorkers()
+	var profile string
+	if cpuScheme.GetID() != 0 {
+		profile = cpuScheme.GetProfile().String()
+	}
+	mensj += fmt.Sprintf("CPU: %d workers active, target %d%% per worker, achieved %.1f%%\n", active, cpuScheme.GetPercent(), cpuScheme.GetAchievedLoad())
+	sum := map[string]interface{}{
+		"time": time.Now(),
+		"memory": map[string]interface{}{
+			"request_id": partScheme.GetProgressID(),
+			"parts": parts,
+			"total_size": memHeld,
+			"limit": memMax,
+			"running": memRunning,
+			"queued": memQueued,
+			"ttl": memTTL.Status(),
+		},
+		"disk": map[string]interface{}{
+			"request_id": frep.RequestID,
+			"files": frep.Files,
+			"total_size": frep.TotalSize,
+			"total_allocated": frep.TotalAllocated,
+			"io_file_size": iosize,
+			"limit": fileMax,
+			"running": fileRunning,
+			"queued": fileQueued,
+			"ttl": fileTTL.Status(),
+		},
+		"cpu": map[string]interface{}{
+			"request_id": cpuScheme.GetID(),
+			"active": active > 0,
+			"active_workers": active,
+			"start": cpuScheme.GetReqTime(),
+			"time": cpuScheme.GetDuration(),
+			"profile": profile,
+			"target_percent": cpuScheme.GetPercent(),
+			"achieved_percent": cpuScheme.GetAchievedLoad(),
+			"default_workers": cpuload.DefaultWorkers(),
+		},
+	}
+	if status, ok := scenarioRunner.Status(); ok {
+		sum["scenario"] = status
+		mensj += fmt.Sprintf("Scenario: %s, %s\n", status.Name, status.State)
+	}
+	reply(writer, request, mensj, sum)
+}
+
+//Exports the state of the consumers in Prometheus text format
+func getMetrics(writer http.ResponseWriter, request *http.Request) {
+	writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	//Memory
+	sizes, counts := partScheme.HeldParts()
+	metrics.Header(writer, "testero_memory_parts", "Number of memory parts held, per part size.", "gauge")
+	for index, size := range sizes {
+		metrics.Sample(writer, "testero_memory_parts", float64(counts[index]), "part_size", strconv.FormatUint(size, 10))
+	}
+	metrics.Header(writer, "testero_memory_bytes", "Bytes held in memory parts, per part size.", "gauge")
+	for index, size := range sizes {
+		metrics.Sample(writer, "testero_memory_bytes", float64(counts[index]*size), "part_size", strconv.FormatUint(size, 10))
+	}
+	hilimit, _ := memLimit.Get()
+	metrics.Gauge(writer, "testero_memory_limit_bytes", "Limit for memory requests (HIGHMEMLIM).", float64(hilimit))
+	//Disk
+	frep, err := fileScheme.ActFiles()
+	if err == nil {
+		metrics.Header(writer, "testero_disk_files", "Number of files, per file size.", "gauge")
+		for _, fcount := range frep.Files {
+			metrics.Sample(writer, "testero_disk_files", float64(fcount.Count), "file_size", strconv.FormatUint(fcount.Size, 10))
+		}
+		metrics.Header(writer, "testero_disk_bytes", "Apparent size of the files in bytes, per file size.", "gauge")
+		for _, fcount := range frep.Files {
+			metrics.Sample(writer, "testero_disk_bytes", float64(fcount.TotalSize), "file_size", strconv.FormatUint(fcount.Size, 10))
+		}
+		metrics.Header(writer, "testero_disk_allocated_bytes", "Disk space allocated to the files in bytes, per file size.", "gauge")
+		for _, fcount := range frep.Files {
+			metrics.Sample(writer, "testero_disk_allocated_bytes", float64(fcount.Allocated), "file_size", strconv.FormatUint(fcount.Size, 10))
+		}
+	} else {
+		log.Printf("getMetrics(): Error getting files information: %s", err.Error())
+	}
+	hilimit, _ = fileLimit.Get()
+	metrics.Gauge(writer, "testero_disk_limit_bytes", "Limit for disk requests (HIGHFILELIM).", float64(hilimit))
+	//CPU
+	var cpuActive float64
+	if cpuScheme.GetActiveWorkers() > 0 {
+		cpuActive = 1
+	}
+	metrics.Gauge(writer, "testero_cpu_load_active", "1 if a CPU load request is running.", cpuActive)
+	metrics.Gauge(writer, "testero_cpu_workers_active", "Number of CPU load workers running.", float64(cpuScheme.GetActiveWorkers()))
+	metrics.Gauge(writer, "testero_cpu_target_percent", "Current target load per worker in percent of a CPU.", float64(cpuScheme.GetPercent()))
+	metrics.Gauge(writer, "testero_cpu_duration_seconds", "Load time of the last CPU request.", float64(cpuScheme.GetDuration()))
+	//Request IDs don't fit in a float without losing precision, so they are exported as labels
+	metrics.Header(writer, "testero_request_info", "ID of the last request of every subsystem, 0 if there was none.", "gauge")
+	metrics.Sample(writer, "testero_request_info", 1, "subsystem", "mem", "request_id", strconv.FormatInt(partScheme.GetProgressID(), 10))
+	metrics.Sample(writer, "testero_request_info", 1, "subsystem", "disk", "request_id", strconv.FormatInt(fileScheme.GetID(), 10))
+	metrics.Sample(writer, "testero_request_info", 1, "subsystem", "cpu", "request_id", strconv.FormatInt(cpuScheme.GetID(), 10))
+	//Requests
+	requestCounter.Write(writer, "testero_http_requests_total", "HTTP requests per handler and outcome.")
+}
+
+//Validity of the self signed certificate generated at start up
+const selfSignedValidity = 365 * 24 * time.Hour
+
+//Builds the TLS configuration from the environment variables TLS_CERT_FILE, TLS_KEY_FILE and TLS_SELF_SIGNED.
+//Returns nil if TLS is not enabled
+func getTLSConfig() (*tls.Config, error) {
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	selfSigned := strings.ToLower(os.Getenv("TLS_SELF_SIGNED"))
+	var cert tls.Certificate
+	var err error
+	switch {
+	case certFile != "" || keyFile != "":
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("both TLS_CERT_FILE and TLS_KEY_FILE must be defined")
+		}
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load certificate %s and key %s: %s", certFile, keyFile, err.Error())
+		}
+		log.Printf("TLS certificate loaded from: %s", certFile)
+	case selfSigned == "true" || selfSigned == "yes" || selfSigned == "1":
+		cert, err = selfSignedCert()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate self signed certificate: %s", err.Error())
+		}
+		log.Printf("Using a self signed TLS certificate generated in memory, valid for %s", selfSignedValidity)
+	default:
+		return nil, nil
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+//Generates a self signed certificate, valid for the host name, localhost and the listening address
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{Organization: []string{"testero"}, CommonName: hostname},
+		NotBefore: time.Now().Add(-1 * time.Hour), //Some margin for clock skew
+		NotAfter: time.Now().Add(selfSignedValidity),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames: []string{hostname, "localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1"), net.IPv6loopback},
+	}
+	if lip := net.ParseIP(ip); lip != nil && !lip.IsUnspecified() && !lip.IsLoopback() {
+		template.IPAddresses = append(template.IPAddresses, lip)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+//Maximum size of a scenario posted to /api/scenario
+const maxScenarioSize = 1048576
+
+//Runs the scenario steps through the same queues and locks as the API requests
+type scenarioExecutor struct{}
+
+//Queues a memory request behind any other
+func (scenarioExecutor) SetMemory(size uint64, fill string) (int64, error) {
+	tstamp := time.Now().UnixNano()
+	_, err := submitMem(tstamp, units.Size{Bytes: size, Operation: units.Set}, fill, defaultTTL, requests.PolicyQueue)
+	return tstamp, err
+}
+
+//Queues a disk request behind any other
+func (scenarioExecutor) SetDisk(size uint64, content partdisk.FileContent, mode string) (int64, error) {
+	tstamp := time.Now().UnixNano()
+	_, err := submitFiles(tstamp, units.Size{Bytes: size, Operation: units.Set}, content, mode, defaultTTL, requests.PolicyQueue)
+	return tstamp, err
+}
+
+//Starts a CPU load, stopping the current one first
+func (scenarioExecutor) StartCPU(duration uint64, workers int, profile cpuload.LoadProfile) (int64, error) {
+	tstamp := time.Now().UnixNano()
+	if workers == 0 {
+		workers = cpuload.DefaultWorkers()
+	}
+	//Wait for the current load to stop, if any
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		lval, islav := getLock(cpulock)
+		if islav && lval == 0 {
+			break
+		} else if islav { //There is a pending request, give it time to start
+			freeLock(cpulock, &lval)
+		} else {
+			cpuload.StopLoad(&cpuScheme, cpuScheme.GetID())
+		}
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("timeout waiting for the current CPU load to stop")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	startLoad(tstamp, duration, workers, profile)
+	freeLock(cpulock, &tstamp) //Hand over the lock to the load
+	return tstamp, nil
+}
+
+//Stops the current CPU load, if any
+func (scenarioExecutor) StopCPU() error {
+	lval, islav := getLock(cpulock)
+	if islav { //No load running
+		freeLock(cpulock, &lval)
+		return nil
+	}
+	cpuload.StopLoad(&cpuScheme, cpuScheme.GetID())
+	return nil
+}
+
+//Reads a scenario file and starts it
+func loadScenario(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	sc, err := scenario.Parse(data)
+	if err != nil {
+		return err
+	}
+	return scenarioRunner.Start(sc)
+}
+
+//Starts the scenario in YAML or JSON sent in the body of a POST request
+func startScenario(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, "The scenario must be sent in the body of a POST request\n")
+		return
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, maxScenarioSize+1))
+	if err != nil {
+		replyError(writer, request, errInvalid, fmt.Sprintf("Could not read the scenario: %s\n", err.Error()))
+		return
+	} else if len(data) > maxScenarioSize {
+		replyError(writer, request, errInvalid, fmt.Sprintf("Scenario too large, maximum size is %d bytes\n", maxScenarioSize))
+		return
+	}
+	sc, err := scenario.Parse(data)
+	if err != nil {
+		time.Sleep(1 * time.Second)
+		replyError(writer, request, errInvalid, fmt.Sprintf("Invalid scenario: %s\n", err.Error()))
+		return
+	}
+	err = scenarioRunner.Start(sc)
+	if err != nil {
+		replyError(writer, request, errPending, fmt.Sprintf("Scenario not started, %s\n", err.Error()))
+		return
+	}
+	reply(writer, request, fmt.Sprintf("Scenario %s started with %d steps, check /api/scenario/status\n", sc.Name, len(sc.Steps)),
+		map[string]interface{}{"name": sc.Name, "steps": len(sc.Steps), "state": scenario.Running})
+}
+
+//Reports the state of the current or last scenario
+func getScenarioStatus(writer http.ResponseWriter, request *http.Request) {
+	status, ok := scenarioRunner.Status()
+	if !ok {
+		replyError(writer, request, errNoRequest, "No scenario has been started\n")
+		return
+	}
+	reply(writer, request, status.String(), status)
+}
+
+//Returns a handler that applies a change of state to the running scenario
+func changeScenario(done string, change func() error) http.HandlerFunc {
+	return func(writer http.ResponseWriter, request *http.Request) {
+		err := change()
+		if err == scenario.ErrNoScenario {
+			replyError(writer, request, errNoRequest, "No scenario has been started\n")
+			return
+		} else if err != nil {
+			replyError(writer, request, errPending, fmt.Sprintf("Scenario not %s, %s\n", done, err.Error()))
+			return
+		}
+		status, _ := scenarioRunner.Status()
+		reply(writer, request, fmt.Sprintf("Scenario %s %s\n", status.Name, done), map[string]interface{}{"name": status.Name, "state": status.State})
+	}
 }
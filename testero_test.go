@@ -0,0 +1,96 @@
+package main
+
+import (
+	"github.com/tale-toul/testero/cgroup"
+	"github.com/tale-toul/testero/partmem"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGetSizeParam(t *testing.T) {
+	tests := []struct {
+		query, size string
+	}{
+		{"size=512Mi", "512Mi"},
+		{"size=%2B256Mi", "+256Mi"},
+		{"size=+256Mi", "+256Mi"},
+		{"size=-1Gi", "-1Gi"},
+		{"fill=zero&size=+1Gi&ttl=1h", "+1Gi"},
+		{"sizes=1Gi&size=2Gi", "2Gi"},
+		{"fill=zero", ""},
+		{"size=", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		request, err := http.NewRequest("GET", "/api/mem/set?"+tt.query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := getSizeParam(request); size != tt.size {
+			t.Errorf("getSizeParam(%q) = %q, want %q", tt.query, size, tt.size)
+		}
+	}
+}
+
+func TestAutoMemLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	previous := cgroup.Root
+	cgroup.Root = dir
+	defer func() { cgroup.Root = previous }()
+	partScheme = partmem.NewpC()
+	tests := []struct {
+		max, current string
+		limit uint64
+	}{
+		{"1000000000\n", "400000000\n", 600000000},
+		{"1000000000\n", "1000000000\n", 0}, //Usage at the limit, nothing is available
+		{"1000000000\n", "1200000000\n", 0},
+	}
+	for _, tt := range tests {
+		files := map[string]string{"cgroup.controllers": "", "memory.max": tt.max, "memory.current": tt.current, "memory.stat": ""}
+		for name, content := range files {
+			if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		limit, source, err := autoMemLimit()
+		if err != nil || limit != tt.limit {
+			t.Errorf("autoMemLimit() with usage %s and limit %s = %d, %v, want %d", tt.current, tt.max, limit, err, tt.limit)
+		}
+		if !strings.HasPrefix(source, "cgroup v2 limit") {
+			t.Errorf("autoMemLimit() source = %s, want the cgroup limit", source)
+		}
+	}
+}
+
+func TestParseMbps(t *testing.T) {
+	tests := []struct {
+		rate string
+		bits uint64
+		fail bool
+	}{
+		{"80", 80000000, false},
+		{"0.5", 500000, false},
+		{"0", 0, false},
+		{"8e-06", 8, false},
+		{"0.000008", 8, false},
+		{"0.000007", 0, true},
+		{"0.0000001", 0, true},
+		{"-1", 0, true},
+		{"fast", 0, true},
+	}
+	for _, tt := range tests {
+		bits, err := parseMbps(tt.rate)
+		if (err != nil) != tt.fail || bits != tt.bits {
+			t.Errorf("parseMbps(%q) = %d, %v, want %d, fail %t", tt.rate, bits, err, tt.bits, tt.fail)
+		}
+	}
+}
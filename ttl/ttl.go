@@ -0,0 +1,129 @@
+package ttl
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+//Time to wait before trying again a release that could not be queued
+const retryDelay = 10 * time.Second
+
+//Error returned when there is no allocation to change the time to live of
+var ErrNoAllocation = errors.New("there is no allocation")
+
+//Function that releases the allocation made by request id.  Returns false if the release could not be started and must be tried again later
+type ReleaseFunc func(id int64) bool
+
+//Time to live of the current allocation of a subsystem.  When it expires the allocation is released
+type Timer struct {
+	name string //Name used in log messages
+	release ReleaseFunc
+	mutex sync.Mutex
+	id int64 //Request that made the current allocation, 0 if there is none
+	ttl time.Duration //Time to live requested, 0 means no expiration
+	expires time.Time
+	timer *time.Timer
+}
+
+//State of the timer
+type Status struct {
+	RequestID int64 `json:"request_id"`
+	TTL float64 `json:"ttl_seconds"` //0 means no expiration
+	Remaining float64 `json:"remaining_seconds"`
+	Expires string `json:"expires,omitempty"`
+}
+
+//Creates a timer that calls release when the time to live expires
+func New(name string, release ReleaseFunc) *Timer {
+	return &Timer{name: name, release: release}
+}
+
+//Sets the allocation made by request id, that expires after ttl.  A ttl of 0 means no expiration, an id of 0 means there is no allocation
+func (t *Timer) Set(id int64, ttl time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.id = id
+	if id == 0 {
+		ttl = 0
+	}
+	t.start(ttl)
+}
+
+//Changes the time to live of the current allocation, counting from now.  A ttl of 0 removes the expiration
+func (t *Timer) Extend(ttl time.Duration) (Status, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.id == 0 {
+		return Status{}, ErrNoAllocation
+	}
+	t.start(ttl)
+	log.Printf("ttl.Extend(): Time to live of %s request %d set to %s", t.name, t.id, ttl)
+	return t.status(), nil
+}
+
+//Starts the timer for the current allocation.  Must be called with the mutex locked
+func (t *Timer) start(ttl time.Duration) {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+	t.ttl = ttl
+	t.expires = time.Time{}
+	if ttl > 0 {
+		t.expires = time.Now().Add(ttl)
+		id := t.id
+		t.timer = time.AfterFunc(ttl, func() { t.expire(id) })
+	}
+}
+
+//Releases the allocation made by request id, if it is still the current one
+func (t *Timer) expire(id int64) {
+	t.mutex.Lock()
+	if t.id != id || t.expires.IsZero() || time.Now().Before(t.expires) { //The allocation or its time to live changed in the meantime
+		t.mutex.Unlock()
+		return
+	}
+	t.mutex.Unlock()
+	log.Printf("ttl.expire(): Time to live of %s request %d expired, releasing", t.name, id)
+	if !t.release(id) {
+		log.Printf("ttl.expire(): Could not release %s request %d, trying again in %s", t.name, id, retryDelay)
+		t.mutex.Lock()
+		if t.id == id && t.timer != nil {
+			t.timer.Reset(retryDelay)
+		}
+		t.mutex.Unlock()
+	}
+}
+
+//Returns the state of the timer
+func (t *Timer) Status() Status {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.status()
+}
+
+//Returns the state of the timer.  Must be called with the mutex locked
+func (t *Timer) status() Status {
+	st := Status{RequestID: t.id, TTL: t.ttl.Seconds()}
+	if !t.expires.IsZero() {
+		remaining := time.Until(t.expires)
+		if remaining < 0 {
+			remaining = 0
+		}
+		st.Remaining = remaining.Seconds()
+		st.Expires = t.expires.Format(time.RFC3339)
+	}
+	return st
+}
+
+//Describes the time to live in one line
+func (st Status) String() string {
+	if st.Expires == "" {
+		return "Time to live: none\n"
+	}
+	remaining := time.Duration(st.Remaining * float64(time.Second)).Round(time.Second)
+	return fmt.Sprintf("Time to live: %s of %s left, expires at %s\n", remaining, time.Duration(st.TTL*float64(time.Second)), st.Expires)
+}
@@ -0,0 +1,164 @@
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Multipliers of the size suffixes, binary ones like Mi are powers of 1024 and decimal ones like M are powers of 1000.
+//The suffixes are case insensitive and can end with B, so 512Mi, 512MiB and 512mib are the same size
+var sizeSuffixes = map[string]float64{
+	"": 1,
+	"k": 1e3, "m": 1e6, "g": 1e9, "t": 1e12,
+	"ki": 1 << 10, "mi": 1 << 20, "gi": 1 << 30, "ti": 1 << 40,
+}
+
+//Parses a size in bytes, like 1048576, 512Mi, 2G or 1.5GiB.  Fractions are rounded down to a whole number of bytes
+func ParseSize(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	//Split the number from the suffix
+	end := len(value)
+	for end > 0 && !(value[end-1] >= '0' && value[end-1] <= '9' || value[end-1] == '.') {
+		end--
+	}
+	number, suffix := value[:end], strings.ToLower(value[end:])
+	if number == "" {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	if suffix != "b" {
+		suffix = strings.TrimSuffix(suffix, "b")
+	} else {
+		suffix = ""
+	}
+	mult, ok := sizeSuffixes[suffix]
+	if !ok {
+		return 0, fmt.Errorf("invalid size unit in %q, valid units are: K, M, G, T, Ki, Mi, Gi, Ti", value)
+	}
+	if suffix == "" && !strings.Contains(number, ".") { //Plain number of bytes, parsed as an integer to keep full precision
+		size, err := strconv.ParseUint(number, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid size: %q", value)
+		}
+		return size, nil
+	}
+	num, err := strconv.ParseFloat(number, 64)
+	if err != nil || num < 0 {
+		return 0, fmt.Errorf("invalid size: %q", value)
+	}
+	size := math.Floor(num * mult)
+	if size >= math.MaxUint64 {
+		return 0, fmt.Errorf("size out of range: %q", value)
+	}
+	return uint64(size), nil
+}
+
+//Formats a size in bytes with the largest binary unit that keeps at least 1, like 512Mi or 1.5Gi
+func FormatSize(size uint64) string {
+	units := []string{"Ti", "Gi", "Mi", "Ki"}
+	for index, unit := range units {
+		mult := uint64(1) << (10 * uint(len(units)-index))
+		if size >= mult {
+			return strconv.FormatFloat(math.Floor(float64(size)/float64(mult)*100)/100, 'f', -1, 64) + unit
+		}
+	}
+	return strconv.FormatUint(size, 10) + "B"
+}
+
+//Parses a duration, like 90 (seconds), 90s, 5m or 1h30m
+func ParseDuration(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	if secs, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return time.Duration(secs) * time.Second, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration: %q, use a number of seconds or a value like 90s, 5m or 1h30m", value)
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("invalid duration: %q, must not be negative", value)
+	}
+	return duration, nil
+}
+
+//Parses the length of a load, at least one second, and rounds it up to whole seconds
+func ParseSeconds(value string) (uint64, error) {
+	duration, err := ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if duration < time.Second {
+		return 0, fmt.Errorf("invalid duration: %q, must be at least 1 second", strings.TrimSpace(value))
+	}
+	return uint64((duration + time.Second - 1) / time.Second), nil
+}
+
+//Operations of a size parameter
+const (
+	Set = "set" //Set the size to the value
+	Grow = "grow" //Add the value to the current size
+	Shrink = "shrink" //Subtract the value from the current size
+)
+
+//A size that replaces the current one, or changes it when written with a leading + or -
+type Size struct {
+	Bytes uint64
+	Operation string
+}
+
+//Parses an absolute size like 512Mi, or a relative one like +256Mi or -1Gi
+func ParseRelativeSize(value string) (Size, error) {
+	value = strings.TrimSpace(value)
+	size := Size{Operation: Set}
+	if strings.HasPrefix(value, "+") {
+		size.Operation = Grow
+	} else if strings.HasPrefix(value, "-") {
+		size.Operation = Shrink
+	}
+	var err error
+	size.Bytes, err = ParseSize(strings.TrimLeft(value, "+-"))
+	if size.Operation != Set && len(value) > 1 && strings.ContainsAny(value[1:2], "+-") {
+		err = fmt.Errorf("invalid size: %q", value)
+	}
+	return size, err
+}
+
+//Computes the new size from the current one.  Shrinking below 0 gives 0
+func (sz Size) Apply(current uint64) (uint64, error) {
+	switch sz.Operation {
+	case Grow:
+		if current+sz.Bytes < current {
+			return 0, fmt.Errorf("size out of range: %d bytes plus %d bytes", current, sz.Bytes)
+		}
+		return current + sz.Bytes, nil
+	case Shrink:
+		if sz.Bytes > current {
+			return 0, nil
+		}
+		return current - sz.Bytes, nil
+	}
+	return sz.Bytes, nil
+}
+
+//Sign written before relative sizes
+func (sz Size) sign() string {
+	switch sz.Operation {
+	case Grow:
+		return "+"
+	case Shrink:
+		return "-"
+	}
+	return ""
+}
+
+//Number of bytes with the sign of relative sizes, like +268435456
+func (sz Size) String() string {
+	return sz.sign() + strconv.FormatUint(sz.Bytes, 10)
+}
+
+//Human readable form with the sign of relative sizes, like +256Mi
+func (sz Size) Human() string {
+	return sz.sign() + FormatSize(sz.Bytes)
+}
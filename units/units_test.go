@@ -0,0 +1,171 @@
+package units
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size uint64
+		fail bool
+	}{
+		{"1048576", 1048576, false},
+		{"512Mi", 512 << 20, false},
+		{"512MiB", 512 << 20, false},
+		{"512mib", 512 << 20, false},
+		{"2G", 2000000000, false},
+		{"2k", 2000, false},
+		{"1.5Gi", 3 << 29, false},
+		{"0.5Ki", 512, false},
+		{"100B", 100, false},
+		{"18446744073709551615", 18446744073709551615, false},
+		{"18446744073709551616", 0, true},
+		{"16777216Ti", 0, true},
+		{"3XB", 0, true},
+		{"Mi", 0, true},
+		{"", 0, true},
+		{"-1Gi", 0, true},
+		{"1.2.3M", 0, true},
+	}
+	for _, tt := range tests {
+		size, err := ParseSize(tt.value)
+		if (err != nil) != tt.fail || size != tt.size {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d, fail %t", tt.value, size, err, tt.size, tt.fail)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size uint64
+		human string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1Ki"},
+		{256000, "250Ki"},
+		{3 << 29, "1.5Gi"},
+		{2333111, "2.22Mi"},
+		{5 << 40, "5Ti"},
+	}
+	for _, tt := range tests {
+		if human := FormatSize(tt.size); human != tt.human {
+			t.Errorf("FormatSize(%d) = %s, want %s", tt.size, human, tt.human)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value string
+		duration time.Duration
+		fail bool
+	}{
+		{"90", 90 * time.Second, false},
+		{"0", 0, false},
+		{"90s", 90 * time.Second, false},
+		{"5m", 5 * time.Minute, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1.5s", 1500 * time.Millisecond, false},
+		{" 30s ", 30 * time.Second, false},
+		{"-5m", 0, true},
+		{"5 minutes", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		duration, err := ParseDuration(tt.value)
+		if (err != nil) != tt.fail || duration != tt.duration {
+			t.Errorf("ParseDuration(%q) = %s, %v, want %s, fail %t", tt.value, duration, err, tt.duration, tt.fail)
+		}
+	}
+}
+
+func TestParseSeconds(t *testing.T) {
+	tests := []struct {
+		value string
+		secs uint64
+		fail bool
+	}{
+		{"90", 90, false},
+		{"1", 1, false},
+		{"5m", 300, false},
+		{"1.5s", 2, false},
+		{"1m0.001s", 61, false},
+		{"0", 0, true},
+		{"0.5s", 0, true},
+		{"999ms", 0, true},
+		{"-5s", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		secs, err := ParseSeconds(tt.value)
+		if (err != nil) != tt.fail || secs != tt.secs {
+			t.Errorf("ParseSeconds(%q) = %d, %v, want %d, fail %t", tt.value, secs, err, tt.secs, tt.fail)
+		}
+	}
+}
+
+func TestParseRelativeSize(t *testing.T) {
+	tests := []struct {
+		value string
+		size Size
+		fail bool
+	}{
+		{"512Mi", Size{512 << 20, Set}, false},
+		{"0", Size{0, Set}, false},
+		{"+256Mi", Size{256 << 20, Grow}, false},
+		{"-1Gi", Size{1 << 30, Shrink}, false},
+		{"+0", Size{0, Grow}, false},
+		{"++1Gi", Size{}, true},
+		{"+-1Gi", Size{}, true},
+		{"-", Size{}, true},
+		{"+3XB", Size{}, true},
+	}
+	for _, tt := range tests {
+		size, err := ParseRelativeSize(tt.value)
+		if (err != nil) != tt.fail || (!tt.fail && size != tt.size) {
+			t.Errorf("ParseRelativeSize(%q) = %+v, %v, want %+v, fail %t", tt.value, size, err, tt.size, tt.fail)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		size Size
+		current uint64
+		result uint64
+		fail bool
+	}{
+		{Size{512, Set}, 1024, 512, false},
+		{Size{0, Set}, 1024, 0, false},
+		{Size{256, Grow}, 1024, 1280, false},
+		{Size{256, Shrink}, 1024, 768, false},
+		{Size{2048, Shrink}, 1024, 0, false},
+		{Size{1024, Shrink}, 1024, 0, false},
+		{Size{1, Grow}, 18446744073709551615, 0, true},
+	}
+	for _, tt := range tests {
+		result, err := tt.size.Apply(tt.current)
+		if (err != nil) != tt.fail || result != tt.result {
+			t.Errorf("%+v.Apply(%d) = %d, %v, want %d, fail %t", tt.size, tt.current, result, err, tt.result, tt.fail)
+		}
+	}
+}
+
+func TestSizeString(t *testing.T) {
+	tests := []struct {
+		size Size
+		plain, human string
+	}{
+		{Size{256 << 20, Set}, "268435456", "256Mi"},
+		{Size{256 << 20, Grow}, "+268435456", "+256Mi"},
+		{Size{1 << 30, Shrink}, "-1073741824", "-1Gi"},
+	}
+	for _, tt := range tests {
+		if tt.size.String() != tt.plain || tt.size.Human() != tt.human {
+			t.Errorf("%+v = %s and %s, want %s and %s", tt.size, tt.size.String(), tt.size.Human(), tt.plain, tt.human)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+"use strict";
+
+//Seconds between refreshes, and number of samples kept in the chart (5 minutes)
+const refreshInterval = 2;
+const chartSamples = 150;
+
+const history = [];
+let summary = null;
+
+const $ = (id) => document.getElementById(id);
+
+//Formats a size in bytes with binary units, like the API does
+function formatSize(bytes) {
+  const units = ["Ti", "Gi", "Mi", "Ki"];
+  for (let i = 0; i < units.length; i++) {
+    const mult = Math.pow(1024, units.length - i);
+    if (bytes >= mult) {
+      return Math.floor(bytes / mult * 100) / 100 + units[i];
+    }
+  }
+  return bytes + "B";
+}
+
+function log(text) {
+  const line = new Date().toLocaleTimeString() + " " + text.trim() + "\n";
+  $("log").textContent = line + $("log").textContent;
+}
+
+//Calls an API endpoint and returns the decoded JSON response.  Errors are thrown with the message of the API
+async function api(path, params) {
+  const query = new URLSearchParams(params || {});
+  query.set("format", "json");
+  const headers = { Accept: "application/json" };
+  const token = $("token").value;
+  if (token) {
+    headers.Authorization = "Bearer " + token;
+  }
+  const response = await fetch(path + "?" + query.toString(), { headers: headers });
+  //Request IDs don't fit in a JavaScript number, so they are turned into strings before decoding
+  const text = (await response.text()).replace(/"request_id":\s*(\d+)/g, '"request_id":"$1"');
+  let body = {};
+  try {
+    body = JSON.parse(text);
+  } catch (err) {
+    body = {};
+  }
+  if (!response.ok) {
+    const err = body.error || { code: response.status, message: response.statusText };
+    throw new Error(err.message + " (" + err.code + ")");
+  }
+  return body;
+}
+
+//Sends a request that changes the state and logs the result
+async function mutate(path, params, describe) {
+  try {
+    const body = await api(path, params);
+    log(describe(body));
+    refresh();
+  } catch (err) {
+    log("Error: " + err.message);
+  }
+}
+
+function fillTable(table, rows) {
+  const tbody = $(table).querySelector("tbody");
+  tbody.innerHTML = "";
+  for (const row of rows || []) {
+    const tr = document.createElement("tr");
+    for (const value of [formatSize(row.size), row.count, formatSize(row.total_size)]) {
+      const td = document.createElement("td");
+      td.textContent = value;
+      tr.appendChild(td);
+    }
+    tbody.appendChild(tr);
+  }
+}
+
+function describeQueue(part) {
+  let text = part.running ? "request running" : "idle";
+  if (part.queued > 0) {
+    text += ", " + part.queued + " queued";
+  }
+  if (part.ttl && part.ttl.expires) {
+    text += ", expires in " + Math.round(part.ttl.remaining_seconds) + "s";
+  }
+  return text;
+}
+
+function render() {
+  const mem = summary.memory, disk = summary.disk, cpu = summary.cpu;
+  $("mem-total").textContent = formatSize(mem.total_size);
+  $("mem-limit").textContent = formatSize(mem.limit);
+  $("mem-info").textContent = describeQueue(mem);
+  fillTable("mem-parts", mem.parts);
+  $("disk-total").textContent = formatSize(disk.total_size);
+  $("disk-limit").textContent = formatSize(disk.limit);
+  $("disk-info").textContent = describeQueue(disk) + ", " + formatSize(disk.total_allocated || 0) + " allocated";
+  fillTable("disk-files", disk.files);
+  $("cpu-achieved").textContent = cpu.achieved_percent.toFixed(1) + "%";
+  if (cpu.active) {
+    const elapsed = Math.floor((Date.now() - new Date(cpu.start).getTime()) / 1000);
+    $("cpu-info").textContent = cpu.active_workers + " workers, " + cpu.profile + ", target " + cpu.target_percent +
+      "% per worker, second " + elapsed + " of " + cpu.time;
+  } else {
+    $("cpu-info").textContent = "no load running, " + cpu.default_workers + " workers by default";
+  }
+  drawChart();
+}
+
+function drawChart() {
+  const canvas = $("chart");
+  const ctx = canvas.getContext("2d");
+  canvas.width = canvas.clientWidth;
+  const width = canvas.width, height = canvas.height;
+  ctx.clearRect(0, 0, width, height);
+  let max = 1;
+  for (const sample of history) {
+    max = Math.max(max, sample.mem, sample.disk);
+  }
+  $("chart-max").textContent = "max " + formatSize(max) + ", last " + (chartSamples * refreshInterval / 60) + " minutes";
+  ctx.strokeStyle = "#e4e7eb";
+  for (let i = 1; i < 4; i++) {
+    ctx.beginPath();
+    ctx.moveTo(0, height * i / 4);
+    ctx.lineTo(width, height * i / 4);
+    ctx.stroke();
+  }
+  for (const [key, color] of [["mem", "#1971c2"], ["disk", "#e8590c"]]) {
+    ctx.strokeStyle = color;
+    ctx.lineWidth = 2;
+    ctx.beginPath();
+    history.forEach((sample, i) => {
+      const x = width - (history.length - 1 - i) * width / (chartSamples - 1);
+      const y = height - 2 - sample[key] / max * (height - 4);
+      if (i === 0) {
+        ctx.moveTo(x, y);
+      } else {
+        ctx.lineTo(x, y);
+      }
+    });
+    ctx.stroke();
+  }
+}
+
+async function refresh() {
+  try {
+    summary = await api("/api/summary");
+    $("state").textContent = "connected";
+    $("state").className = "state ok";
+  } catch (err) {
+    $("state").textContent = err.message;
+    $("state").className = "state error";
+    return;
+  }
+  history.push({ mem: summary.memory.total_size, disk: summary.disk.total_size });
+  while (history.length > chartSamples) {
+    history.shift();
+  }
+  render();
+}
+
+//Links a slider to a size input, the slider goes from 0 to the limit in steps of 1%
+function sizeSlider(slider, input, part) {
+  $(slider).addEventListener("input", () => {
+    if (summary) {
+      const bytes = summary[part].limit * $(slider).value / 100;
+      $(input).value = Math.floor(bytes / 1048576) + "Mi";
+    }
+  });
+}
+
+function describeSubmitted(kind) {
+  return (body) => kind + " request " + body.request_id + " " + body.operation + " " + body.size_human + ", " + body.state;
+}
+
+function setup() {
+  $("token").value = localStorage.getItem("testero-token") || "";
+  $("token").addEventListener("change", () => {
+    localStorage.setItem("testero-token", $("token").value);
+    refresh();
+  });
+  sizeSlider("mem-slider", "mem-size", "memory");
+  sizeSlider("disk-slider", "disk-size", "disk");
+  $("cpu-percent").addEventListener("input", () => {
+    $("cpu-percent-value").textContent = $("cpu-percent").value + "%";
+  });
+
+  $("mem-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const params = { size: $("mem-size").value, fill: $("mem-fill").value };
+    if ($("mem-ttl").value) {
+      params.ttl = $("mem-ttl").value;
+    }
+    mutate("/api/mem/set", params, describeSubmitted("Memory"));
+  });
+  $("mem-release").addEventListener("click", () => {
+    mutate("/api/mem/release", {}, (body) => "Memory release request " + body.request_id + ", " + body.state);
+  });
+  $("disk-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const params = { size: $("disk-size").value, content: $("disk-content").value, mode: $("disk-mode").value };
+    if ($("disk-ttl").value) {
+      params.ttl = $("disk-ttl").value;
+    }
+    mutate("/api/disk/set", params, describeSubmitted("Disk"));
+  });
+  $("disk-release").addEventListener("click", () => {
+    mutate("/api/disk/release", {}, (body) => "Disk release request " + body.request_id + ", " + body.state);
+  });
+  $("cpu-form").addEventListener("submit", (event) => {
+    event.preventDefault();
+    const params = { time: $("cpu-time").value, percent: $("cpu-percent").value };
+    if (Number($("cpu-workers").value) > 0) {
+      params.workers = $("cpu-workers").value;
+    }
+    mutate("/api/cpu/load", params, (body) => "CPU load request " + body.request_id + " for " + body.time_human + ", " +
+      body.profile + ", " + body.workers + " workers");
+  });
+  for (const [kind, part] of [["mem", "memory"], ["disk", "disk"]]) {
+    $(kind + "-cancel").addEventListener("click", () => {
+      if (!summary || !summary[part].running) {
+        log("No " + part + " request running");
+        return;
+      }
+      mutate("/api/" + kind + "/cancel", { id: summary[part].request_id }, (body) => "Cancel of request " + body.request_id + ", " + body.state);
+    });
+  }
+  $("cpu-stop").addEventListener("click", () => {
+    const id = summary ? summary.cpu.request_id : "";
+    mutate("/api/cpu/stop", { id: id }, () => "CPU load stopped");
+  });
+
+  refresh();
+  setInterval(refresh, refreshInterval * 1000);
+}
+
+setup();
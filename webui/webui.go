@@ -0,0 +1,20 @@
+package webui
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//Files of the web interface, built into the binary
+//go:embed static
+var static embed.FS
+
+//Returns a handler that serves the web interface.  The page calls the API endpoints from the browser
+func Handler() http.Handler {
+	root, err := fs.Sub(static, "static")
+	if err != nil { //Only fails if the embed directive is wrong
+		panic(err)
+	}
+	return http.FileServer(http.FS(root))
+}